@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"unicode/utf8"
+)
+
+// Minimum amount of free space the gap is grown by.
+// The whole buffer grows geometrically beyond this.
+const TEXT_GAP_MIN = 10240
+
+//----- Gap buffer holding the text being edited -----------------
+// The text is kept in one byte slice with a hole ("gap") in it:
+//
+//  buf: | text before gap | gap (unused) | text after gap |
+//       0           gap_start        gap_end           len(buf)
+//
+// Inserting or deleting moves the gap to the edit position first,
+// so a run of edits at the cursor only shifts the bytes between
+// two consecutive edit positions instead of the rest of the file.
+// Positions used by the editor are logical offsets that skip the gap.
+type text_buffer struct {
+	buf       []byte
+	gap_start int
+	gap_end   int
+	lines     line_index
+}
+
+func new_text_buffer(size int) *text_buffer {
+	size = TernaryInt(size < TEXT_GAP_MIN, TEXT_GAP_MIN, size)
+	return &text_buffer{buf: make([]byte, size), gap_end: size}
+}
+
+func (t *text_buffer) gap_len() int {
+	return t.gap_end - t.gap_start
+}
+
+// number of bytes of text
+func (t *text_buffer) size() int {
+	return len(t.buf) - t.gap_len()
+}
+
+// byte at p, 0 when p is outside the text
+func (t *text_buffer) at(p int) byte {
+	if p < 0 || p >= t.size() {
+		return 0
+	}
+	if p >= t.gap_start {
+		p += t.gap_len()
+	}
+	return t.buf[p]
+}
+
+// move the gap so that it starts at p
+func (t *text_buffer) move_gap(p int) {
+	if p < t.gap_start {
+		n := t.gap_start - p
+		copy(t.buf[t.gap_end-n:t.gap_end], t.buf[p:t.gap_start])
+		t.gap_start -= n
+		t.gap_end -= n
+	} else if p > t.gap_start {
+		n := p - t.gap_start
+		copy(t.buf[t.gap_start:t.gap_start+n], t.buf[t.gap_end:t.gap_end+n])
+		t.gap_start += n
+		t.gap_end += n
+	}
+}
+
+// make sure the gap can take at least n more bytes
+func (t *text_buffer) grow(n int) {
+	if t.gap_len() >= n {
+		return
+	}
+	size := t.size()
+	newcap := 2 * len(t.buf)
+	if newcap < size+n+TEXT_GAP_MIN {
+		newcap = size + n + TEXT_GAP_MIN
+	}
+	nb := make([]byte, newcap)
+	copy(nb, t.buf[:t.gap_start])
+	tail := len(t.buf) - t.gap_end
+	copy(nb[newcap-tail:], t.buf[t.gap_end:])
+	t.buf = nb
+	t.gap_end = newcap - tail
+}
+
+// open a hole of n bytes at p and return it so the caller can fill it.
+// p outside the text is taken as its start or end.
+func (t *text_buffer) hole(p int, n int) []byte {
+	p = TernaryInt(p < 0, 0, TernaryInt(p > t.size(), t.size(), p))
+	n = TernaryInt(n < 0, 0, n)
+	t.index_move(p)
+	t.lines.fill_p, t.lines.fill_n = p, n
+	t.move_gap(p)
+	t.grow(n)
+	h := t.buf[t.gap_start : t.gap_start+n]
+	t.gap_start += n
+	return h
+}
+
+func (t *text_buffer) insert(p int, s []byte) {
+	copy(t.hole(p, len(s)), s)
+}
+
+// remove n bytes starting at p, or those of them inside the text
+func (t *text_buffer) delete(p int, n int) {
+	if p < 0 {
+		n, p = n+p, 0
+	}
+	n = TernaryInt(n > t.size()-p, t.size()-p, n)
+	if n <= 0 {
+		return
+	}
+	t.index_move(p)
+	l := &t.lines
+	for l.gap_end < len(l.nl) && t.size()-l.nl[l.gap_end] < p+n {
+		l.gap_end++ // a '\n' deleted
+	}
+	t.move_gap(p)
+	t.gap_end += n
+}
+
+// slice returns text[from:to] as one contiguous slice. The gap is moved
+// out of the way if it splits the range. The result aliases the buffer
+// and is only valid until the next change.
+func (t *text_buffer) slice(from, to int) []byte {
+	if to <= t.gap_start {
+		return t.buf[from:to]
+	}
+	if from >= t.gap_start {
+		return t.buf[from+t.gap_len() : to+t.gap_len()]
+	}
+	t.move_gap(to)
+	return t.buf[from:to]
+}
+
+// copy_out returns a private copy of text[from:to]
+func (t *text_buffer) copy_out(from, to int) []byte {
+	out := make([]byte, 0, to-from)
+	if from < t.gap_start {
+		out = append(out, t.buf[from:TernaryInt(to < t.gap_start, to, t.gap_start)]...)
+	}
+	if to > t.gap_start {
+		from = TernaryInt(from > t.gap_start, from, t.gap_start)
+		out = append(out, t.buf[from+t.gap_len():to+t.gap_len()]...)
+	}
+	return out
+}
+
+// the two pieces of text[from:to] on either side of the gap
+func (t *text_buffer) pieces(from, to int) ([]byte, []byte) {
+	if to <= t.gap_start {
+		return t.buf[from:to], nil
+	}
+	if from >= t.gap_start {
+		return nil, t.buf[from+t.gap_len() : to+t.gap_len()]
+	}
+	return t.buf[from:t.gap_start], t.buf[t.gap_end : to+t.gap_len()]
+}
+
+// index of the first c in text[from:to], or -1
+func (t *text_buffer) index_byte(from, to int, c byte) int {
+	a, b := t.pieces(from, to)
+	if n := bytes.IndexByte(a, c); n >= 0 {
+		return from + n
+	}
+	if n := bytes.IndexByte(b, c); n >= 0 {
+		return from + len(a) + n
+	}
+	return -1
+}
+
+// index of the last c in text[from:to], or -1
+func (t *text_buffer) last_index_byte(from, to int, c byte) int {
+	a, b := t.pieces(from, to)
+	if n := bytes.LastIndexByte(b, c); n >= 0 {
+		return from + len(a) + n
+	}
+	if n := bytes.LastIndexByte(a, c); n >= 0 {
+		return from + n
+	}
+	return -1
+}
+
+// number of c in text[from:to]
+func (t *text_buffer) count(from, to int, c byte) int {
+	a, b := t.pieces(from, to)
+	return bytes.Count(a, []byte{c}) + bytes.Count(b, []byte{c})
+}
+
+// the rune starting at p and its length in bytes. Invalid UTF-8
+// decodes as utf8.RuneError of length 1, so every byte is reachable.
+func (t *text_buffer) rune_at(p int) (rune, int) {
+	c := t.at(p)
+	if c < utf8.RuneSelf {
+		return rune(c), 1
+	}
+	var b [utf8.UTFMax]byte
+	n := 0
+	for ; n < utf8.UTFMax && p+n < t.size(); n++ {
+		b[n] = t.at(p + n)
+	}
+	return utf8.DecodeRune(b[:n])
+}
+
+//----- Line index -----------------------------------------------
+// The offsets of the '\n's, kept up to date by the edits so line
+// numbers and line starts are found without scanning the text.
+// Like the text it has a gap, at the last edit: the offsets before
+// it are from the start of the text, those after it from the end,
+// so an edit only moves the entries between it and the last one.
+type line_index struct {
+	nl        []int
+	gap_start int
+	gap_end   int
+	fill_p    int // a hole the caller is still filling, for
+	fill_n    int // its '\n's to be added on the next use
+}
+
+// number of '\n's in the text
+func (t *text_buffer) newlines() int {
+	t.index_fill()
+	return t.lines.gap_start + len(t.lines.nl) - t.lines.gap_end
+}
+
+// offset of the i-th '\n', from 0
+func (t *text_buffer) newline_at(i int) int {
+	l := &t.lines
+	if i < l.gap_start {
+		return l.nl[i]
+	}
+	return t.size() - l.nl[l.gap_end+i-l.gap_start]
+}
+
+// number of '\n's before p
+func (t *text_buffer) line_of(p int) int {
+	n := t.newlines()
+	return sort.Search(n, func(i int) bool { return t.newline_at(i) >= p })
+}
+
+// offset of the start of line n, from 0. Past the last line it is
+// the end of the text.
+func (t *text_buffer) line_start(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	if n > t.newlines() {
+		return t.size()
+	}
+	return t.newline_at(n-1) + 1
+}
+
+// add the '\n's of the last hole to the index
+func (t *text_buffer) index_fill() {
+	l := &t.lines
+	p, n := l.fill_p, l.fill_n
+	if n == 0 {
+		return
+	}
+	l.fill_n = 0
+	for q := t.index_byte(p, p+n, '\n'); q >= 0; q = t.index_byte(q+1, p+n, '\n') {
+		if l.gap_start == l.gap_end {
+			l.grow()
+		}
+		l.nl[l.gap_start] = q
+		l.gap_start++
+	}
+}
+
+// move the gap of the index to p: the '\n's before p go before it
+func (t *text_buffer) index_move(p int) {
+	t.index_fill()
+	l := &t.lines
+	size := t.size()
+	for l.gap_start > 0 && l.nl[l.gap_start-1] >= p {
+		l.gap_start--
+		l.gap_end--
+		l.nl[l.gap_end] = size - l.nl[l.gap_start]
+	}
+	for l.gap_end < len(l.nl) && size-l.nl[l.gap_end] < p {
+		l.nl[l.gap_start] = size - l.nl[l.gap_end]
+		l.gap_start++
+		l.gap_end++
+	}
+}
+
+func (l *line_index) grow() {
+	n := 2 * len(l.nl)
+	n = TernaryInt(n < 64, 64, n)
+	nl := make([]int, n)
+	copy(nl, l.nl[:l.gap_start])
+	tail := len(l.nl) - l.gap_end
+	copy(nl[n-tail:], l.nl[l.gap_end:])
+	l.nl = nl
+	l.gap_end = n - tail
+}
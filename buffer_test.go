@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+const bench_text_size = 4 << 20
+
+func bench_text() []byte {
+	return bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), bench_text_size/44)
+}
+
+// flat_text is the storage used before the gap buffer: one slice that
+// is shifted on every insert and grown in fixed 10240 byte steps.
+type flat_text struct {
+	text []byte
+	end  int
+}
+
+func (f *flat_text) insert(p int, c byte) {
+	f.end++
+	if f.end >= len(f.text) {
+		new_text := make([]byte, f.end+10240)
+		copy(new_text, f.text)
+		f.text = new_text
+	}
+	copy(f.text[p+1:], f.text[p:f.end-1])
+	f.text[p] = c
+}
+
+func (f *flat_text) delete(p int) {
+	copy(f.text[p:], f.text[p+1:f.end])
+	f.end--
+}
+
+func new_flat_text() *flat_text {
+	src := bench_text()
+	f := &flat_text{text: make([]byte, len(src)+10240), end: len(src)}
+	copy(f.text, src)
+	return f
+}
+
+func new_gap_text() *text_buffer {
+	src := bench_text()
+	t := new_text_buffer(len(src))
+	t.insert(0, src)
+	return t
+}
+
+func BenchmarkFlatInsertTop(b *testing.B) {
+	f := new_flat_text()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.insert(i%64, 'x')
+	}
+}
+
+func BenchmarkGapInsertTop(b *testing.B) {
+	t := new_gap_text()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t.insert(i%64, []byte{'x'})
+	}
+}
+
+func BenchmarkFlatInsertEnd(b *testing.B) {
+	f := new_flat_text()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.insert(f.end, 'x')
+	}
+}
+
+func BenchmarkGapInsertEnd(b *testing.B) {
+	t := new_gap_text()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t.insert(t.size(), []byte{'x'})
+	}
+}
+
+func BenchmarkFlatDeleteTop(b *testing.B) {
+	f := new_flat_text()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if f.end == 0 {
+			b.StopTimer()
+			f = new_flat_text()
+			b.StartTimer()
+		}
+		f.delete(0)
+	}
+}
+
+func BenchmarkGapDeleteTop(b *testing.B) {
+	t := new_gap_text()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if t.size() == 0 {
+			b.StopTimer()
+			t = new_gap_text()
+			b.StartTimer()
+		}
+		t.delete(0, 1)
+	}
+}
+
+// the gap buffer against a plain slice, over random edits
+func TestTextBuffer(t *testing.T) {
+	tb := new_text_buffer(0)
+	var model []byte
+	rnd := rand.New(rand.NewSource(2))
+	for i := 0; i < 1000; i++ {
+		p := rnd.Intn(len(model)+20) - 10 // sometimes outside the text
+		switch n := rnd.Intn(512); rnd.Intn(3) {
+		case 0:
+			tb.delete(p, n/4)
+			q, e := TernaryInt(p < 0, 0, p), p+n/4
+			q, e = TernaryInt(q > len(model), len(model), q), TernaryInt(e > len(model), len(model), e)
+			if e > q {
+				model = append(model[:q], model[e:]...)
+			}
+		default:
+			s := make([]byte, n)
+			for j := range s {
+				s[j] = "ab\nc"[rnd.Intn(4)]
+			}
+			copy(tb.hole(p, n), s)
+			q := TernaryInt(p < 0, 0, TernaryInt(p > len(model), len(model), p))
+			model = append(model[:q], append(s, model[q:]...)...)
+		}
+		if tb.size() != len(model) {
+			t.Fatalf("edit %d: size %d, want %d", i, tb.size(), len(model))
+		}
+		from := rnd.Intn(len(model) + 1)
+		to := from + rnd.Intn(len(model)-from+1)
+		want := model[from:to]
+		a, b := tb.pieces(from, to)
+		switch {
+		case !bytes.Equal(append(append([]byte(nil), a...), b...), want):
+			t.Fatalf("edit %d: pieces(%d, %d) differ", i, from, to)
+		case !bytes.Equal(tb.copy_out(from, to), want):
+			t.Fatalf("edit %d: copy_out(%d, %d) differs", i, from, to)
+		case tb.index_byte(from, to, '\n') != index_or(bytes.IndexByte(want, '\n'), from):
+			t.Fatalf("edit %d: index_byte(%d, %d)", i, from, to)
+		case tb.last_index_byte(from, to, '\n') != index_or(bytes.LastIndexByte(want, '\n'), from):
+			t.Fatalf("edit %d: last_index_byte(%d, %d)", i, from, to)
+		case tb.count(from, to, 'c') != bytes.Count(want, []byte{'c'}):
+			t.Fatalf("edit %d: count(%d, %d)", i, from, to)
+		case from < len(model) && tb.at(from) != model[from]:
+			t.Fatalf("edit %d: at(%d)", i, from)
+		case !bytes.Equal(tb.slice(from, to), want): // last, it moves the gap
+			t.Fatalf("edit %d: slice(%d, %d) differs", i, from, to)
+		}
+	}
+}
+
+// n from a search in text[from:], as an offset in the whole text
+func index_or(n, from int) int {
+	return TernaryInt(n < 0, -1, from+n)
+}
+
+// the line index against counting the '\n's, over random edits
+func TestLineIndex(t *testing.T) {
+	tb := new_text_buffer(0)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		p := rnd.Intn(tb.size() + 1)
+		if rnd.Intn(3) == 0 && p < tb.size() {
+			tb.delete(p, rnd.Intn(tb.size()-p)/4+1)
+		} else {
+			s := bytes.Repeat([]byte("ab\n"), rnd.Intn(5))
+			copy(tb.hole(p, len(s)+1), append(s, 'c'))
+		}
+		if n := tb.count(0, tb.size(), '\n'); tb.newlines() != n {
+			t.Fatalf("edit %d: %d newlines, want %d", i, tb.newlines(), n)
+		}
+		q := rnd.Intn(tb.size() + 1)
+		if l := tb.line_of(q); l != tb.count(0, q, '\n') {
+			t.Fatalf("edit %d: line_of(%d) = %d, want %d", i, q, l, tb.count(0, q, '\n'))
+		}
+		if s := tb.line_start(tb.line_of(q)); s > q || (s > 0 && tb.at(s-1) != '\n') ||
+			tb.index_byte(s, q, '\n') >= 0 {
+			t.Fatalf("edit %d: line_start(line_of(%d)) = %d", i, q, s)
+		}
+	}
+}
+
+// a window of rows at the end of a 100k line file
+const bench_rows = 24
+
+func bench_globals() *globals {
+	var g globals
+	g.rows, g.columns, g.tabstop = bench_rows+1, 80, 8
+	g.buffer = &buffer{text: new_text_buffer(0)}
+	g.text.insert(0, bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 100000))
+	g.win_init()
+	g.screenbegin = g.find_line(100000 - bench_rows)
+	return &g
+}
+
+// line numbers as they were found before the index: counting the
+// '\n's before and after each row
+func BenchmarkLineNumberScan(b *testing.B) {
+	g := bench_globals()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for r, tp := 0, g.screenbegin; r < bench_rows; r, tp = r+1, g.next_line(tp) {
+			_ = g.text.count(0, tp, '\n') + g.text.count(tp, g.text.size(), '\n')
+		}
+	}
+}
+
+func BenchmarkLineNumberIndex(b *testing.B) {
+	g := bench_globals()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for r, tp := 0, g.screenbegin; r < bench_rows; r, tp = r+1, g.next_line(tp) {
+			g.format_line_number(tp)
+		}
+	}
+}
+
+// the rows of a redraw, with the line numbers
+func BenchmarkRedrawRows(b *testing.B) {
+	g := bench_globals()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for r, tp := 0, g.screenbegin; r < bench_rows; r, tp = r+1, g.next_line(tp) {
+			g.format_line(tp, false)
+		}
+	}
+}
+
+// G to a line as it was found before: a line at a time from the start
+func BenchmarkGotoLineScan(b *testing.B) {
+	g := bench_globals()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := 0
+		for li := 90000; li > 1; li-- {
+			p = g.next_line(p)
+		}
+	}
+}
+
+func BenchmarkGotoLineIndex(b *testing.B) {
+	g := bench_globals()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.find_line(90000)
+	}
+}
+
+// typing at the top keeps the index up to date
+func BenchmarkInsertTopIndexed(b *testing.B) {
+	g := bench_globals()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.text.insert(i%64, []byte{'\n'})
+		g.format_line_number(g.screenbegin)
+	}
+}
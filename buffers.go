@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//----- Buffers: :ls :b :bd :bn :bp ----------------------------
+// Each file being edited has a buffer with its own text, cursor,
+// marks and undo history. The current one is embedded in globals,
+// so g.text and g.dot are its fields. A buffer left with unsaved
+// changes stays loaded only when 'hidden' is set (or a ! is given
+// to :b and such), otherwise it must be written first.
+type buffer struct {
+	num              int // :b N
+	text             *text_buffer
+	current_filename string
+	dot              int
+	screenbegin      int
+	modified_count   int
+	undo             undo_journal
+
+	visual_last_mode  int // the last selection, for gv '< '>
+	visual_last_start int
+	visual_last_end   int
+
+	marks    map[int]int // a-z and the special marks, see marks.go
+	jumps    []int
+	jump_idx int // ctrl-O ctrl-I position in jumps
+}
+
+// a new buffer for file f on the buffer list, not yet loaded
+func (g *globals) buffer_new(f string) *buffer {
+	g.buffer_num++
+	b := &buffer{num: g.buffer_num, current_filename: f}
+	g.buffers = append(g.buffers, b)
+	return b
+}
+
+// the buffer for file f, nil if there is none
+func (g *globals) buffer_find(f string) *buffer {
+	for _, b := range g.buffers {
+		if b.current_filename == f {
+			return b
+		}
+	}
+	return nil
+}
+
+// the buffer :b and :bd name with arg: its number or a part of its
+// file name that only one buffer has
+func (g *globals) buffer_arg(arg string) (*buffer, error) {
+	if arg == "" || arg == "%" {
+		return g.buffer, nil
+	}
+	if arg == "#" {
+		if g.alt_buf == nil {
+			return nil, fmt.Errorf("No alternate file")
+		}
+		return g.alt_buf, nil
+	}
+	if n, err := strconv.Atoi(arg); err == nil {
+		for _, b := range g.buffers {
+			if b.num == n {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("Buffer %d does not exist", n)
+	}
+	var found *buffer
+	for _, b := range g.buffers {
+		if b.current_filename == arg {
+			return b, nil
+		}
+		if strings.Contains(b.current_filename, arg) {
+			if found != nil {
+				return nil, fmt.Errorf("More than one match for %s", arg)
+			}
+			found = b
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("No matching buffer for %s", arg)
+	}
+	return found, nil
+}
+
+// buffer_may_hide tells if buffer b may go out of n of the windows
+// showing it: it has no changes, or they are kept, in another window
+// or in the hidden buffer with hidden set or with force.
+func (g *globals) buffer_may_hide(b *buffer, n int, force bool) bool {
+	return b.modified_count == 0 || g.hidden || force || g.buffer_windows(b) > n
+}
+
+// buffer_discard throws away the changes of b, for :e! :n! :q!,
+// unless more than n windows show it. Its file is read again when
+// it is shown next.
+func (g *globals) buffer_discard(b *buffer, n int) {
+	if b.modified_count == 0 || g.buffer_windows(b) > n {
+		return
+	}
+	b.text, b.modified_count = nil, 0
+	b.undo = undo_journal{}
+}
+
+// can the current buffer be left: see buffer_may_hide, or else it
+// is written with autowrite
+func (g *globals) buffer_leave(force bool) bool {
+	if g.buffer_may_hide(g.buffer, 1, force) {
+		return true
+	}
+	if g.autowrite && g.current_filename != "" {
+		return g.file_save(g.current_filename)
+	}
+	g.status_line_bold("No write since last change (add ! to override)")
+	return false
+}
+
+// make b the current buffer, loading its file the first time
+func (g *globals) buffer_switch(b *buffer) {
+	if b != g.buffer {
+		g.alt_buf = g.buffer
+		g.buffer = b
+		g.win.buf = b
+	}
+	if g.text == nil {
+		g.init_text_buffer(g.current_filename)
+	}
+	g.quit_warned = false
+	g.cmd_mode = 0
+	g.visual_mode = 0
+	g.redraw(true)
+	g.file_info()
+}
+
+// line of the cursor in buffer b
+func (b *buffer) line() int {
+	if b.text == nil {
+		return 0
+	}
+	return b.text.count(0, b.dot, '\n') + 1
+}
+
+// :ls  the buffer list. % is the current buffer, # the alternate,
+// a one shown, h one loaded but hidden, + one with unsaved changes.
+func (g *globals) ex_ls() {
+	var lines []string
+	for _, b := range g.buffers {
+		cur := TernaryString(b == g.buffer, "%", TernaryString(b == g.alt_buf, "#", " "))
+		state := TernaryString(b == g.buffer, "a", TernaryString(b.text != nil, "h", " "))
+		mod := TernaryString(b.modified_count != 0, "+", " ")
+		name := TernaryString(b.current_filename == "", "[No Name]", b.current_filename)
+		lines = append(lines, fmt.Sprintf("%3d %s%s %s %-30s line %d", b.num, cur, state, mod, "\""+name+"\"", b.line()))
+	}
+	g.show_lines(lines)
+}
+
+// :b[uffer][!] N|name
+func (g *globals) ex_buffer(arg string, bang bool) {
+	b, err := g.buffer_arg(arg)
+	if err != nil {
+		g.status_line_bold("%v", err)
+		return
+	}
+	if b != g.buffer && g.buffer_leave(bang) {
+		g.buffer_switch(b)
+	}
+}
+
+// :bn[ext] (dir > 0) and :bp[revious], cnt buffers on, around the list
+func (g *globals) ex_bnext(dir int, cnt int, bang bool) {
+	i := 0
+	for i < len(g.buffers) && g.buffers[i] != g.buffer {
+		i++
+	}
+	n := len(g.buffers)
+	i = ((i+dir*TernaryInt(cnt < 1, 1, cnt))%n + n) % n
+	if g.buffers[i] != g.buffer && g.buffer_leave(bang) {
+		g.buffer_switch(g.buffers[i])
+	}
+}
+
+// :bd[elete][!] [N|name]  take a buffer off the list. For the current
+// one the alternate (or another) buffer is shown, or an empty one.
+func (g *globals) ex_bdelete(arg string, bang bool) {
+	b, err := g.buffer_arg(arg)
+	if err != nil {
+		g.status_line_bold("%v", err)
+		return
+	}
+	if b.modified_count != 0 && !bang {
+		g.status_line_bold("No write since last change for buffer %d (add ! to override)", b.num)
+		return
+	}
+	i := 0
+	for g.buffers[i] != b {
+		i++
+	}
+	g.buffers = append(g.buffers[:i], g.buffers[i+1:]...)
+	if g.alt_buf == b {
+		g.alt_buf = nil
+	}
+	if b != g.buffer {
+		g.each_window(func(w *window) {
+			if w.buf == b {
+				w.buf, w.dot, w.screenbegin = g.buffer, g.dot, g.screenbegin
+			}
+		})
+		return
+	}
+	next := g.alt_buf
+	if next == nil && len(g.buffers) > 0 {
+		next = g.buffers[TernaryInt(i < len(g.buffers), i, len(g.buffers)-1)]
+	}
+	if next == nil {
+		next = g.buffer_new("")
+	}
+	g.buffer = next
+	g.win.buf = next
+	g.alt_buf = nil
+	g.each_window(func(w *window) { // other windows on it show next too
+		if w.buf == b {
+			w.buf, w.dot, w.screenbegin = next, next.dot, next.screenbegin
+		}
+	})
+	g.buffer_switch(next)
+}
+
+// a changed buffer that is not shown, for :q to complain about
+func (g *globals) buffer_hidden_changed() *buffer {
+	for _, b := range g.buffers {
+		if b != g.buffer && b.modified_count != 0 {
+			return b
+		}
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package main
 
-import "unsafe"
+import (
+	"unicode/utf8"
+	"unsafe"
+)
 
 func BytesToStr(bts []byte) string {
 	return *(*string)(unsafe.Pointer(&bts))
@@ -19,6 +22,20 @@ func TernaryInt(cond bool, a, b int) int {
 	return b
 }
 
+func TernaryRune(cond bool, a, b rune) rune {
+	if cond {
+		return a
+	}
+	return b
+}
+
+func TernaryString(cond bool, a, b string) string {
+	if cond {
+		return a
+	}
+	return b
+}
+
 func DoWhile(exec func(), stop func() bool) {
 	for {
 		exec()
@@ -27,3 +44,9 @@ func DoWhile(exec func(), stop func() bool) {
 		}
 	}
 }
+
+func RuneToBytes(r rune) []byte {
+	var b [utf8.UTFMax]byte
+	n := utf8.EncodeRune(b[:], r)
+	return b[:n]
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+//----- Event loop -----------------------------------------------
+// Keys, changes of the terminal size and timers arrive as events on
+// one channel. They are all handled on the main goroutine while it
+// waits for a key, so nothing else touches the screen or the text.
+const (
+	EVENT_INPUT  = iota // bytes read from the terminal
+	EVENT_RESIZE        // the terminal changed size
+	EVENT_TIMER         // a timer went off, its fn runs
+)
+
+type event struct {
+	kind  int
+	input []byte
+	err   error  // reading the terminal failed
+	fn    func() // what a timer runs
+}
+
+// start the goroutines that turn input and resizes into events
+func (g *globals) events_start() {
+	g.events = make(chan event, 16)
+	g.term.on_resize(func() { g.events <- event{kind: EVENT_RESIZE} })
+	go g.input_reader()
+}
+
+// send what is read from the terminal as events, until it fails
+func (g *globals) input_reader() {
+	for {
+		buf := make([]byte, 256)
+		n, err := g.term.read(buf)
+		if n > 0 {
+			g.events <- event{kind: EVENT_INPUT, input: buf[:n]}
+		}
+		if err != nil {
+			g.events <- event{kind: EVENT_INPUT, err: err}
+			return
+		}
+	}
+}
+
+// is there input read but not yet decoded
+func (g *globals) input_ready() bool {
+	return g.readbuffer[0] > 0 || len(g.input) > 0
+}
+
+// wait_input handles events until input arrives and returns it.
+// timeout >= 0 gives up after that many ms, returning nil: a timer
+// event then ends the wait. Without a timeout it returns nil when the
+// terminal changed size, for the caller to draw the screen again (see
+// get_one_char). A failed read is returned as the error.
+func (g *globals) wait_input(timeout int) ([]byte, error) {
+	expired := false
+	if timeout >= 0 {
+		t := time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			g.events <- event{kind: EVENT_TIMER, fn: func() { expired = true }}
+		})
+		defer t.Stop()
+	}
+	for !expired {
+		ev := <-g.events
+		switch ev.kind {
+		case EVENT_INPUT:
+			if ev.err != nil {
+				log.Printf("read err %v", ev.err)
+			}
+			return ev.input, ev.err
+		case EVENT_RESIZE:
+			g.query_screen_dimensions()
+			g.new_screen(g.rows, g.columns)
+			g.win_layout()
+			g.screen_dirty = true
+			if timeout < 0 {
+				return nil, nil
+			}
+		case EVENT_TIMER:
+			ev.fn()
+			g.out_flush()
+		}
+	}
+	return nil, nil
+}
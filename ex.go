@@ -0,0 +1,707 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//----- Ex addresses --------------------------------------------
+//  .        the current line
+//  $        the last line
+//  N        line N
+//  'x       the line of mark x
+//  /pat/    the next line matching pat, ?pat? the previous one
+//  +N -N    N lines down/up from the address before, or from .
+//  %        all lines, 1,$
+// Two addresses separated by ',' make a range. With ';' the first
+// address becomes the current line for the second one.
+
+// ex_range is the lines an ex command works on, numbered from 1
+type ex_range struct {
+	naddr int // number of addresses given
+	first int
+	last  int
+}
+
+var (
+	err_invalid_range = errors.New("Invalid range")
+	err_mark_not_set  = errors.New("Mark not set")
+)
+
+// number of lines in the text, a last line without '\n' counts
+func (g *globals) line_count() int {
+	n := g.text.newlines()
+	if s := g.text.size(); s > 0 && g.text.at(s-1) != '\n' {
+		n++
+	}
+	return n
+}
+
+// line number of position p, from 1
+func (g *globals) line_of(p int) int {
+	return g.text.line_of(p) + 1
+}
+
+// ex_address parses one address at the start of s. It returns its
+// line number, -1 if s does not start with an address, and the rest of s.
+func (g *globals) ex_address(s string, cur int) (int, string, error) {
+	s = strings.TrimLeft(s, " \t")
+	line := -1
+	switch {
+	case s == "":
+		return -1, s, nil
+	case s[0] == '.':
+		line, s = cur, s[1:]
+	case s[0] == '$':
+		line, s = g.line_count(), s[1:]
+	case s[0] >= '0' && s[0] <= '9':
+		i := 1
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		line, _ = strconv.Atoi(s[:i])
+		s = s[i:]
+	case s[0] == '\'':
+		if len(s) < 2 {
+			return -1, s, err_mark_not_set
+		}
+		p := g.mark_get(int(s[1]))
+		if p < 0 {
+			return -1, s, err_mark_not_set
+		}
+		line, s = g.line_of(p), s[2:]
+	case s[0] == '/' || s[0] == '?':
+		dir := TernaryInt(s[0] == '/', 1, -1)
+		pat, rest := search_split(s[1:], s[0])
+		s = rest
+		if pat == "" {
+			pat = g.last_search_pattern
+		}
+		if pat == "" {
+			return -1, s, errors.New("No previous regular expression")
+		}
+		g.last_search_pattern, g.last_search_dir = pat, dir
+		re, err := vi_regexp(pat)
+		if err != nil {
+			return -1, s, fmt.Errorf("Invalid pattern: %s", pat)
+		}
+		// search from the end (start) of the current line, so the
+		// current line itself matches only after wrapping around
+		p := g.find_line(cur)
+		p = TernaryInt(dir > 0, g.end_line(p), p)
+		start, _, _ := g.char_search(p, re, dir)
+		if start < 0 {
+			return -1, s, fmt.Errorf("Pattern not found: %s", pat)
+		}
+		line = g.line_of(start)
+	}
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" || (s[0] != '+' && s[0] != '-') {
+			break
+		}
+		sign := TernaryInt(s[0] == '+', 1, -1)
+		i := 1
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		n := 1
+		if i > 1 {
+			n, _ = strconv.Atoi(s[1:i])
+		}
+		line = TernaryInt(line < 0, cur, line) + sign*n
+		s = s[i:]
+	}
+	return line, s, nil
+}
+
+// ex_get_range parses the addresses in front of an ex command.
+// Without addresses the range is the current line.
+func (g *globals) ex_get_range(s string) (ex_range, string, error) {
+	cur := g.line_of(g.dot)
+	r := ex_range{first: cur, last: cur}
+	s = strings.TrimLeft(s, " \t")
+	if strings.HasPrefix(s, "%") {
+		return ex_range{naddr: 2, first: 1, last: g.line_count()}, s[1:], nil
+	}
+	for {
+		line, rest, err := g.ex_address(s, cur)
+		if err != nil {
+			return r, rest, err
+		}
+		s = rest
+		if line < 0 {
+			if !strings.HasPrefix(s, ",") && !strings.HasPrefix(s, ";") && r.naddr == 0 {
+				break
+			}
+			line = cur // ",5" is ".,5", "5," is "5,."
+		}
+		r.first, r.last = r.last, line
+		r.naddr++
+		if strings.HasPrefix(s, ";") {
+			cur = line
+		} else if !strings.HasPrefix(s, ",") {
+			break
+		}
+		s = s[1:]
+	}
+	if r.naddr == 1 {
+		r.first = r.last
+	}
+	if r.first > r.last {
+		r.first, r.last = r.last, r.first
+	}
+	if r.first < 0 || r.last > g.line_count() {
+		return r, s, err_invalid_range
+	}
+	return r, s, nil
+}
+
+//----- :s/pat/rep/[&cgiI] [count] ------------------------------
+// In rep & is the whole match, \1 - \9 the groups, ~ the replacement
+// of the last :s and \r a line break. Without pat the last search
+// pattern is used. :s and :& with no pattern repeat the last :s,
+// :&& with its flags.
+func (g *globals) ex_substitute(r ex_range, arg string) {
+	pat, rep, flags := g.last_sub_pattern, g.last_sub_rep, ""
+	if arg != "" && strings.IndexByte("&cgiI ", arg[0]) < 0 && !unicode.IsDigit(rune(arg[0])) {
+		delim := arg[0]
+		if unicode.IsLetter(rune(delim)) || strings.IndexByte("\\\"|", delim) >= 0 {
+			g.status_line_bold("Regular expressions can't be delimited by letters")
+			return
+		}
+		var rest string
+		pat, rest = search_split(arg[1:], delim)
+		if pat == "" {
+			pat = g.last_search_pattern
+		}
+		rep, arg = sub_split(rest, delim)
+		rep = sub_tilde(rep, g.last_sub_rep)
+	} else if pat == "" {
+		g.status_line_bold("No previous substitute regular expression")
+		return
+	}
+	if strings.HasPrefix(arg, "&") {
+		flags, arg = g.last_sub_flags, arg[1:]
+	}
+	for arg != "" && strings.IndexByte("cgiI", arg[0]) >= 0 {
+		flags, arg = flags+arg[:1], arg[1:]
+	}
+	if arg = strings.TrimSpace(arg); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			g.status_line_bold("Trailing characters: %s", arg)
+			return
+		}
+		r.first = r.last
+		r.last = TernaryInt(r.last+n-1 > g.line_count(), g.line_count(), r.last+n-1)
+	}
+	g.last_sub_pattern, g.last_sub_rep, g.last_sub_flags = pat, rep, flags
+	g.last_search_pattern, g.last_search_dir = pat, 1 // n searches forward
+
+	re, err := vi_regexp(pat)
+	if err == nil && strings.LastIndexByte(flags, 'i') > strings.LastIndexByte(flags, 'I') {
+		re.re, err = regexp.Compile("(?i)" + re.re.String())
+	}
+	if err != nil {
+		g.status_line_bold("Invalid pattern: %s", pat)
+		return
+	}
+	global := strings.IndexByte(flags, 'g') >= 0
+	ask := strings.IndexByte(flags, 'c') >= 0
+
+	subs, lines, last := 0, 0, -1
+	quit := false
+	p := g.find_line(r.first)
+	for n := r.first; n <= r.last && p < g.text.size() && !quit; n++ {
+		e := g.end_line(p)
+		line := g.text.copy_out(p, e)
+		delta := 0 // how much longer the line got
+		for _, m := range re.find_all(line, TernaryInt(global, -1, 1)) {
+			text := sub_expand(rep, line, m)
+			if ask {
+				g.dot = p + m[0] + delta
+				c := g.sub_confirm(text)
+				if c == 'q' || c == 27 {
+					quit = true
+					break
+				}
+				if c == 'n' {
+					continue
+				}
+				ask = c != 'a'
+				quit = c == 'l' // this one and stop
+			}
+			q := p + m[0] + delta
+			g.string_delete(q, q+m[1]-m[0])
+			g.string_insert(q, text)
+			delta += len(text) - (m[1] - m[0])
+			if last != p {
+				lines++
+			}
+			subs++
+			last = p
+			if quit {
+				break
+			}
+		}
+		p = g.next_line(e + delta)
+	}
+	if subs == 0 {
+		if !quit && g.global_lines == nil { // :g does not mind
+			g.status_line_bold("Pattern not found: %s", pat)
+		}
+		return
+	}
+	g.dot = g.first_nonblank(last)
+	if subs > 2 {
+		g.status_line("%d substitutions on %d lines", subs, lines)
+	}
+}
+
+// ask whether to replace the match at dot, returns the key typed
+func (g *globals) sub_confirm(text []byte) int {
+	old := g.repaint
+	defer func() { g.repaint = old }()
+	g.repaint = func() {
+		g.go_bottom_and_clear_to_eol()
+		g.out_printf("replace with %s (y/n/a/q/l)?", visible_text(text, g.columns/2))
+		g.place_cursor(g.crow, g.ccol+g.line_number_width)
+	}
+	for {
+		g.refresh(false)
+		g.repaint()
+		if c := g.get_one_char(); strings.IndexByte("ynaql\x1b", byte(c)) >= 0 {
+			return c
+		}
+	}
+}
+
+// split the replacement of :s from the flags after it.
+// \ and the delimiter is the delimiter itself.
+func sub_split(s string, delim byte) (string, string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			if s[i+1] != delim {
+				b.WriteByte(c)
+			}
+			b.WriteByte(s[i+1])
+			i++
+			continue
+		}
+		if c == delim {
+			return b.String(), s[i+1:]
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), ""
+}
+
+// replace ~ in rep by the previous replacement
+func sub_tilde(rep string, prev string) string {
+	var b strings.Builder
+	for i := 0; i < len(rep); i++ {
+		switch {
+		case rep[i] == '\\' && i+1 < len(rep):
+			b.WriteString(rep[i : i+2])
+			i++
+		case rep[i] == '~':
+			b.WriteString(prev)
+		default:
+			b.WriteByte(rep[i])
+		}
+	}
+	return b.String()
+}
+
+// the text that replaces match m of line
+func sub_expand(rep string, line []byte, m []int) []byte {
+	var b []byte
+	group := func(n int) {
+		if 2*n+1 < len(m) && m[2*n] >= 0 {
+			b = append(b, line[m[2*n]:m[2*n+1]]...)
+		}
+	}
+	for i := 0; i < len(rep); i++ {
+		c := rep[i]
+		if c == '&' {
+			group(0)
+			continue
+		}
+		if c != '\\' || i+1 == len(rep) {
+			b = append(b, c)
+			continue
+		}
+		i++
+		switch c = rep[i]; {
+		case c >= '0' && c <= '9':
+			group(int(c - '0'))
+		case c == 'r' || c == 'n':
+			b = append(b, '\n')
+		case c == 't':
+			b = append(b, '\t')
+		default: // \& \~ \\ and the like
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+//----- :g/pat/cmd and :v/pat/cmd -------------------------------
+// The first pass marks the lines in the range (all lines by default)
+// that match pat, or do not match for :v and :g!. The second runs
+// cmd on each of them in turn as the current line. Lines gone by
+// then are skipped. It is one ex command and so one undo step.
+func (g *globals) ex_global(r ex_range, arg string, invert bool) {
+	if g.global_lines != nil {
+		g.status_line_bold("Cannot do :global recursive")
+		return
+	}
+	if arg == "" || unicode.IsLetter(rune(arg[0])) || strings.IndexByte("\\\"|", arg[0]) >= 0 {
+		g.status_line_bold("Regular expression missing from :global")
+		return
+	}
+	pat, cmd := search_split(arg[1:], arg[0])
+	if pat == "" {
+		pat = g.last_search_pattern
+	}
+	if pat == "" {
+		g.status_line_bold("No previous regular expression")
+		return
+	}
+	g.last_search_pattern, g.last_search_dir = pat, 1 // n searches forward
+	re, err := vi_regexp(pat)
+	if err != nil {
+		g.status_line_bold("Invalid pattern: %s", pat)
+		return
+	}
+	if r.naddr == 0 {
+		r.first, r.last = 1, g.line_count()
+	}
+
+	lines := []int{}
+	p := g.find_line(r.first)
+	for n := r.first; n <= r.last && p < g.text.size(); n++ {
+		e := g.end_line(p)
+		if (re.find(g.text.slice(p, e), 0) != nil) != invert {
+			lines = append(lines, p)
+		}
+		p = g.next_line(e)
+	}
+	if len(lines) == 0 {
+		g.status_line_bold("Pattern not found: %s", pat)
+		return
+	}
+	if strings.TrimSpace(cmd) == "" { // show the lines
+		out := make([]string, len(lines))
+		for i, l := range lines {
+			out[i] = string(g.text.copy_out(l, g.end_line(l)))
+		}
+		g.show_lines(out)
+		return
+	}
+
+	marks := new_line_marks(lines)
+	g.global_lines = marks
+	g.marked = append(g.marked, marks)
+	for i := range lines {
+		if marks.gone[i] {
+			continue
+		}
+		g.dot = marks.at(g.text, i)
+		g.status_buffer.Reset()
+		g.colon(cmd)
+		if g.editing == 0 {
+			break
+		}
+	}
+	g.marked = g.marked[:len(g.marked)-1]
+	g.global_lines = nil
+}
+
+//----- Lines marked for :g and :normal ------------------------
+// The line starts are kept in place through the edits of the
+// commands run on them (g.marked has those in use). Like the line index they are split at the
+// last edit: the offsets before the split are from the start of the
+// text, those after it from the end, so an edit only moves the
+// marks between it and the last one.
+type line_marks struct {
+	pos   []int  // in order
+	gone  []bool // the line was deleted, or joined to the one before
+	split int
+}
+
+func new_line_marks(lines []int) *line_marks {
+	return &line_marks{pos: lines, gone: make([]bool, len(lines)), split: len(lines)}
+}
+
+// start of marked line i in t
+func (m *line_marks) at(t *text_buffer, i int) int {
+	if i < m.split {
+		return m.pos[i]
+	}
+	return t.size() - m.pos[i]
+}
+
+// move the split to p: the marks before p go before it
+func (m *line_marks) move(t *text_buffer, p int) {
+	size := t.size()
+	for m.split > 0 && m.pos[m.split-1] >= p {
+		m.split--
+		m.pos[m.split] = size - m.pos[m.split]
+	}
+	for m.split < len(m.pos) && size-m.pos[m.split] < p {
+		m.pos[m.split] = size - m.pos[m.split]
+		m.split++
+	}
+}
+
+// text is about to be inserted at p: the marks at p and after it
+// move with the end of the text, a line put above a marked one
+// leaves the mark on the marked line
+func (m *line_marks) insert(t *text_buffer, p int) {
+	m.move(t, p)
+}
+
+// text[p:q] is about to be deleted. A line is gone when its '\n' is
+// deleted, or when it is joined to the end of the line before.
+func (m *line_marks) delete(t *text_buffer, p int, q int) {
+	m.move(t, p)
+	size := t.size()
+	for i := m.split; i < len(m.pos) && size-m.pos[i] <= q; i++ {
+		l := size - m.pos[i]
+		switch {
+		case l == q && p > 0 && t.at(p-1) != '\n':
+			m.gone[i] = true
+		case l == q:
+		case t.index_byte(l, q, '\n') >= 0:
+			m.gone[i] = true
+		}
+		m.pos[i] = size - q // at p once the text is gone
+	}
+}
+
+//----- Line commands: :d :y :m :t :j :> :< :norm ---------------
+
+// start of the first line of r and the start of the line after it
+func (g *globals) ex_span(r ex_range) (int, int) {
+	return g.find_line(r.first), g.next_line(g.find_line(r.last))
+}
+
+// a count after a command makes the range count lines from its last line
+func (g *globals) ex_count(r *ex_range, arg string) error {
+	if arg = strings.TrimSpace(arg); arg == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		return fmt.Errorf("Trailing characters: %s", arg)
+	}
+	r.first = r.last
+	r.last = TernaryInt(r.last+n-1 > g.line_count(), g.line_count(), r.last+n-1)
+	return nil
+}
+
+// :[range]d[elete] [x] [count] and :[range]y[ank] [x] [count]
+func (g *globals) ex_delete_yank(op int, r ex_range, arg string) {
+	if arg != "" && !unicode.IsDigit(rune(arg[0])) {
+		if !valid_reg_name(int(arg[0])) {
+			g.status_line_bold("Invalid register name: %c", arg[0])
+			return
+		}
+		g.cur_reg = int(arg[0])
+		arg = arg[1:]
+	}
+	if err := g.ex_count(&r, arg); err != nil {
+		g.status_line_bold("%v", err)
+		return
+	}
+	if r.first < 1 || g.text.size() == 0 {
+		return
+	}
+	save := g.dot
+	g.op_apply(op, g.find_line(r.first), g.find_line(r.last), MOTION_LINEWISE)
+	if op == 'y' {
+		g.dot = save
+	}
+}
+
+// :[range]m[ove] {address} and :[range]t/co[py] {address} put the lines
+// below line address, 0 for above the first line
+func (g *globals) ex_move_copy(move bool, r ex_range, arg string) {
+	dest, rest, err := g.ex_address(arg, g.line_of(g.dot))
+	if err == nil && (dest < 0 || strings.TrimSpace(rest) != "") {
+		err = err_invalid_range
+	}
+	if err == nil && dest > g.line_count() {
+		err = err_invalid_range
+	}
+	if err != nil {
+		g.status_line_bold("%v", err)
+		return
+	}
+	if r.first < 1 {
+		r.first = 1
+	}
+	if move && dest >= r.first && dest < r.last {
+		g.status_line_bold("Cannot move a range of lines into itself")
+		return
+	}
+	if move && (dest == r.last || dest == r.first-1) {
+		g.dot = g.first_nonblank(g.find_line(r.last)) // already there
+		return
+	}
+	// both the lines and the place they go end in '\n'
+	g.put_line_pos(g.find_line(g.line_count()))
+	p, q := g.ex_span(r)
+	text := g.text.copy_out(p, q)
+	d := 0
+	if dest > 0 {
+		d = g.next_line(g.find_line(dest))
+	}
+	if move && d > p {
+		g.string_insert(d, text)
+		g.string_delete(p, q)
+		d -= q - p
+	} else if move {
+		g.string_delete(p, q)
+		g.string_insert(d, text)
+	} else {
+		g.string_insert(d, text)
+	}
+	g.dot = g.first_nonblank(g.begin_line(d + len(text) - 1))
+	g.report_lines(r.last-r.first+1, TernaryString(move, "moved", "copied"))
+}
+
+// :[range]j[oin][!] [count] joins the lines, or the line with the next
+func (g *globals) ex_join(r ex_range, spaces bool, arg string) {
+	if arg = strings.TrimSpace(arg); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			g.status_line_bold("Trailing characters: %s", arg)
+			return
+		}
+		r.first, r.last = r.last, r.last+n-1
+	} else if r.naddr < 2 {
+		r.last = r.first + 1
+	}
+	r.last = TernaryInt(r.last > g.line_count(), g.line_count(), r.last)
+	if r.first < 1 || r.first >= r.last {
+		return
+	}
+	g.join_lines(g.find_line(r.first), r.last-r.first+1, spaces)
+}
+
+// :[range]> [count] and :[range]< [count], >> shifts twice
+func (g *globals) ex_shift(r ex_range, arg string) {
+	dir := TernaryInt(arg[0] == '>', 1, -1)
+	n := 0
+	for n < len(arg) && arg[n] == arg[0] {
+		n++
+	}
+	if err := g.ex_count(&r, arg[n:]); err != nil {
+		g.status_line_bold("%v", err)
+		return
+	}
+	if r.first < 1 || g.text.size() == 0 {
+		return
+	}
+	l := g.find_line(r.first)
+	for i := r.first; i <= r.last; i++ {
+		for j := 0; j < n; j++ {
+			g.shift_line(l, dir)
+		}
+		l = g.next_line(l)
+	}
+	g.dot = g.first_nonblank(g.find_line(r.last))
+	g.report_lines(r.last-r.first+1, fmt.Sprintf("%sed %d time%s", arg[:1], n, TernaryString(n > 1, "s", "")))
+}
+
+// :[range]norm[al] {keys} runs keys as normal mode commands at the
+// start of each line, once for each line there was. Keys left
+// unfinished are ended with ESC.
+func (g *globals) ex_normal(r ex_range, keys string) {
+	if keys == "" {
+		g.status_line_bold("Argument required")
+		return
+	}
+	if g.ioq_esc {
+		g.status_line_bold("Cannot do :normal recursive")
+		return
+	}
+	// mark the lines first, the keys may add and delete lines
+	var lines []int
+	p := g.find_line(TernaryInt(r.first < 1, 1, r.first))
+	for n := TernaryInt(r.first < 1, 1, r.first); n <= r.last && p < g.text.size(); n++ {
+		lines = append(lines, p)
+		p = g.next_line(p)
+	}
+	marks := new_line_marks(lines)
+	g.marked = append(g.marked, marks)
+	g.ioq_esc = true
+	for i := range lines {
+		if g.editing == 0 {
+			break
+		}
+		if marks.gone[i] {
+			continue
+		}
+		if g.dot = marks.at(g.text, i); g.dot >= g.text.size() {
+			break // the lines after it were deleted
+		}
+		g.cmd_mode = 0
+		for _, c := range keys {
+			g.ioq = append(g.ioq, int(c))
+		}
+		for len(g.ioq) > 0 {
+			g.do_cmd(g.get_one_char())
+		}
+		if g.cmd_mode != 0 {
+			g.do_cmd(27)
+		}
+	}
+	g.ioq_esc = false
+	g.marked = g.marked[:len(g.marked)-1]
+}
+
+//----- :set ----------------------------------------------------
+//  :se[t] aw|autowrite  noaw   write a changed file before :n :e and the like
+//  :se[t] hid|hidden     nohid  keep changed buffers that are not shown
+//  :se[t] ts=N|tabstop=N        sw=N|shiftwidth=N
+func (g *globals) ex_set(arg string) {
+	if arg == "" {
+		g.status_line("%sautowrite %shidden tabstop=%d shiftwidth=%d",
+			TernaryString(g.autowrite, "", "no"), TernaryString(g.hidden, "", "no"), g.tabstop, g.shiftwidth)
+		return
+	}
+	for _, opt := range strings.Fields(arg) {
+		name, val := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			name, val = opt[:i], opt[i+1:]
+		}
+		on := !strings.HasPrefix(name, "no")
+		if !on {
+			name = name[2:]
+		}
+		n, err := strconv.Atoi(val)
+		switch {
+		case (name == "aw" || name == "autowrite") && val == "":
+			g.autowrite = on
+		case (name == "hid" || name == "hidden") && val == "":
+			g.hidden = on
+		case (name == "ts" || name == "tabstop") && on && err == nil && n > 0 && n <= MAX_TABSTOP:
+			g.tabstop = n
+		case (name == "sw" || name == "shiftwidth") && on && err == nil && n > 0:
+			g.shiftwidth = n
+		default:
+			g.status_line_bold("Invalid option: %s", opt)
+			return
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//----- Files: the argument list, :e and the alternate file ----
+// The files named on the command line are the argument list. :n :N
+// :rew :la move along it, :e edits any file. The file edited before
+// is the alternate file, # in :e # and ctrl-^ go back to it.
+// Leaving a changed file fails unless ! is given, which throws the
+// changes away, hidden is set, or it is written first when autowrite
+// is set (see buffer_leave).
+
+// edit file f instead of the current one, in its buffer if it has one.
+// Editing the current file again reads it again.
+func (g *globals) edit_switch(f string, force bool) bool {
+	if f == g.current_filename {
+		if g.modified_count != 0 && !force {
+			g.status_line_bold("No write since last change (add ! to override)")
+			return false
+		}
+		dot := g.dot
+		g.init_text_buffer(f)
+		if dot < g.text.size() {
+			g.dot = g.begin_line(dot)
+			g.dot_skip_over_ws()
+		}
+		g.buffer_switch(g.buffer)
+		return true
+	}
+	if !g.buffer_leave(force) {
+		return false
+	}
+	if force {
+		g.buffer_discard(g.buffer, 1)
+	}
+	b := g.buffer_find(f)
+	if b == nil {
+		b = g.buffer_new(f)
+	}
+	g.buffer_switch(b)
+	return true
+}
+
+// "name" 3L, 40C on the status line
+func (g *globals) file_info() {
+	name := TernaryString(g.current_filename == "", "[No Name]", g.current_filename)
+	if g.modified_count != 0 {
+		name += " [Modified]"
+	}
+	g.status_line("\"%s\" %dL, %dC", name, g.line_count(), g.text.size())
+}
+
+// :e[dit][!] [file]  :e #
+func (g *globals) ex_edit(arg string, bang bool) {
+	f := arg
+	switch arg {
+	case "":
+		f = g.current_filename
+	case "#":
+		if g.alt_buf == nil {
+			g.status_line_bold("No alternate file")
+			return
+		}
+		f = g.alt_buf.current_filename
+	}
+	g.edit_switch(f, bang)
+}
+
+// :n :N :rew :la, cnt files on (back if cnt < 0) along the argument
+// list or to the first (to < 0) or last (to > 0) file
+func (g *globals) ex_next(cnt int, to int, bang bool) {
+	i := g.arg_idx + cnt
+	if to != 0 {
+		i = TernaryInt(to < 0, 0, len(g.args)-1)
+	}
+	if len(g.args) == 0 {
+		g.status_line_bold("There is only one file to edit")
+		return
+	}
+	if i < 0 {
+		g.status_line_bold("Cannot go before first file")
+		return
+	}
+	if i >= len(g.args) {
+		g.status_line_bold("Cannot go beyond last file")
+		return
+	}
+	if g.edit_switch(g.args[i], bang) {
+		g.arg_idx = i
+	}
+}
+
+// :ar[gs]  show the argument list, the current file in []
+// :ar[gs] {files}  start a new one
+func (g *globals) ex_args(arg string, bang bool) {
+	if arg != "" {
+		files := strings.Fields(arg)
+		if g.edit_switch(files[0], bang) {
+			g.args, g.arg_idx = files, 0
+		}
+		return
+	}
+	var b strings.Builder
+	for i, f := range g.args {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		if i == g.arg_idx {
+			fmt.Fprintf(&b, "[%s]", f)
+		} else {
+			b.WriteString(f)
+		}
+	}
+	g.status_line("%s", b.String())
+}
+
+// ctrl-^  edit the alternate file, N ctrl-^ buffer N
+func (g *globals) edit_alternate(n int) {
+	if n > 0 {
+		g.ex_buffer(strconv.Itoa(n), false)
+		return
+	}
+	if g.alt_buf == nil {
+		g.status_line_bold("No alternate file")
+		return
+	}
+	if g.buffer_leave(false) {
+		g.buffer_switch(g.alt_buf)
+	}
+}
+
+// :sp[lit] [file] :vs[plit] [file]  the current buffer or file in a
+// new window. :new :vne[w] an empty one.
+func (g *globals) ex_window_split(vertical bool, empty bool, arg string) {
+	b := g.buffer
+	if empty || arg != "" {
+		if b = g.buffer_find(arg); b == nil || empty {
+			b = g.buffer_new(arg)
+		}
+	}
+	g.win_split(vertical, b)
+}
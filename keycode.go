@@ -1,5 +1,7 @@
 package main
 
+import "unicode/utf8"
+
 const (
 	KEYCODE_UP        = -2
 	KEYCODE_DOWN      = -3
@@ -14,5 +16,271 @@ const (
 	KEYCODE_BACKSPACE = -12 /* Used only if Alt/Ctrl/Shifted */
 	KEYCODE_D         = -13 /* Used only if Alted */
 
+	/* Modifiers clear a bit of the key code:
+	 * KEYCODE_CTRL_LEFT = KEYCODE_LEFT &^ KEYCODE_CTRL, and so on.
+	 * Several modifiers clear several bits.
+	 */
+	KEYCODE_SHIFT = 0x80
+	KEYCODE_CTRL  = 0x40
+	KEYCODE_ALT   = 0x20
+
+	KEYCODE_SHIFT_UP      = KEYCODE_UP &^ KEYCODE_SHIFT
+	KEYCODE_SHIFT_DOWN    = KEYCODE_DOWN &^ KEYCODE_SHIFT
+	KEYCODE_SHIFT_RIGHT   = KEYCODE_RIGHT &^ KEYCODE_SHIFT
+	KEYCODE_SHIFT_LEFT    = KEYCODE_LEFT &^ KEYCODE_SHIFT
+	KEYCODE_CTRL_UP       = KEYCODE_UP &^ KEYCODE_CTRL
+	KEYCODE_CTRL_DOWN     = KEYCODE_DOWN &^ KEYCODE_CTRL
+	KEYCODE_CTRL_RIGHT    = KEYCODE_RIGHT &^ KEYCODE_CTRL
+	KEYCODE_CTRL_LEFT     = KEYCODE_LEFT &^ KEYCODE_CTRL
+	KEYCODE_ALT_RIGHT     = KEYCODE_RIGHT &^ KEYCODE_ALT
+	KEYCODE_ALT_LEFT      = KEYCODE_LEFT &^ KEYCODE_ALT
+	KEYCODE_ALT_BACKSPACE = KEYCODE_BACKSPACE &^ KEYCODE_ALT
+	KEYCODE_ALT_D         = KEYCODE_D &^ KEYCODE_ALT
+
 	KEYCODE_BUFFER_SIZE = 16
+
+	/* How long to wait for the rest of an escape sequence, in ms.
+	 * A lone ESC is returned as ESC once this runs out.
+	 */
+	ESC_TIMEOUT = 50
 )
+
+//----- Input decoder ------------------------------------------
+// readbuffer[0] is the number of bytes taken from the input but
+// not yet decoded, the bytes follow in readbuffer[1:]. g.input holds
+// the rest of what the last input event brought. Bit i of read_starts
+// (read_ends) is set if buffered byte i was the first (last) of a read.
+
+// make sure at least i+1 bytes are buffered. timeout < 0 waits
+// forever, otherwise false is returned if the bytes did not arrive
+// within timeout ms.
+func (g *globals) readbuffer_fill(i int, timeout int) bool {
+	for int(g.readbuffer[0]) <= i {
+		start := false
+		if len(g.input) == 0 {
+			in, err := g.wait_input(timeout)
+			if err != nil {
+				g.read_err = err // get_one_char ends the editing
+				return false
+			}
+			if g.input = in; g.input == nil {
+				if timeout < 0 {
+					continue // a resize, the rest of the key is still to come
+				}
+				return false
+			}
+			start = true
+		}
+		n := int(g.readbuffer[0])
+		c := copy(g.readbuffer[1+n:], g.input)
+		g.input = g.input[c:]
+		g.readbuffer[0] += byte(c)
+		if start {
+			g.read_starts |= 1 << uint(n)
+		}
+		if len(g.input) == 0 && c > 0 {
+			g.read_ends |= 1 << uint(n+c-1)
+		}
+	}
+	return true
+}
+
+func (g *globals) readbuffer_peek(i int, timeout int) (byte, bool) {
+	if i >= KEYCODE_BUFFER_SIZE-1 || !g.readbuffer_fill(i, timeout) {
+		return 0, false
+	}
+	return g.readbuffer[1+i], true
+}
+
+// drop the first n buffered bytes
+func (g *globals) readbuffer_consume(n int) {
+	cnt := int(g.readbuffer[0])
+	copy(g.readbuffer[1:], g.readbuffer[1+n:1+cnt])
+	g.readbuffer[0] = byte(cnt - n)
+	g.read_starts >>= uint(n)
+	g.read_ends >>= uint(n)
+}
+
+// read_key returns the next key: a rune, a control char,
+// or a KEYCODE_xxx for a recognized escape sequence.
+func (g *globals) read_key() int {
+	for {
+		c, _ := g.readbuffer_peek(0, -1)
+		if c != 27 {
+			return g.read_rune()
+		}
+		if k := g.read_esc_sequence(); k != 0 {
+			return k
+		}
+		// unknown sequence, it was dropped
+	}
+}
+
+// a UTF-8 sequence is read whole and returned as one rune
+func (g *globals) read_rune() int {
+	var b [utf8.UTFMax]byte
+	b[0], _ = g.readbuffer_peek(0, -1)
+	n := 1
+	switch {
+	case b[0] >= 0xf0:
+		n = 4
+	case b[0] >= 0xe0:
+		n = 3
+	case b[0] >= 0xc0:
+		n = 2
+	}
+	for i := 1; i < n; i++ {
+		b[i], _ = g.readbuffer_peek(i, -1)
+	}
+	r, size := utf8.DecodeRune(b[:n])
+	g.readbuffer_consume(size)
+	return int(r)
+}
+
+// Decode the escape sequence at the head of readbuffer.
+// Understands xterm/VT100 "ESC [ params final" and "ESC O final",
+// xterm modifier parameters ("ESC [ 1 ; 5 C" = ctrl-right), and the
+// rxvt variants (ESC [ a..d, ESC O a..d, "~" "$" "^" "@" suffixes,
+// ESC ESC [ for Alt). Returns 0 for a complete sequence it does not
+// know, after dropping it.
+func (g *globals) read_esc_sequence() int {
+	mods := 0
+	i := 1
+	c1, ok := g.readbuffer_peek(i, ESC_TIMEOUT)
+	if !ok {
+		g.readbuffer_consume(1)
+		return 27 // a plain ESC
+	}
+	if c1 == 27 {
+		c2, ok := g.readbuffer_peek(i+1, ESC_TIMEOUT)
+		if !ok || (c2 != '[' && c2 != 'O') {
+			g.readbuffer_consume(1)
+			return 27
+		}
+		mods |= KEYCODE_ALT
+		i++
+		c1 = c2
+	}
+	// Alt-d and Alt-backspace come as ESC d and ESC DEL in a read
+	// of their own. ESC typed quickly before d or backspace comes in
+	// a read of its own too, or with more keys.
+	alone := i == 1 && g.read_starts&1 != 0 && g.read_ends&3 == 2
+	switch {
+	case alone && (c1 == 0x7f || c1 == 8):
+		g.readbuffer_consume(2)
+		return KEYCODE_ALT_BACKSPACE
+	case alone && c1 == 'd':
+		g.readbuffer_consume(2)
+		return KEYCODE_ALT_D
+	case c1 != '[' && c1 != 'O':
+		// ESC followed by an ordinary key, e.g. leaving insert
+		// mode and typing a command quickly
+		g.readbuffer_consume(1)
+		return 27
+	}
+
+	var params []int
+	num := -1
+	var final byte
+	private := false // ESC [ ? ..., only seen in answers from the terminal
+	for {
+		i++
+		c, ok := g.readbuffer_peek(i, ESC_TIMEOUT)
+		if !ok {
+			g.readbuffer_consume(1)
+			return 27
+		}
+		if c == '?' && c1 == '[' && num < 0 && len(params) == 0 {
+			private = true
+		} else if c >= '0' && c <= '9' {
+			num = TernaryInt(num < 0, 0, num)*10 + int(c-'0')
+		} else if c == ';' {
+			params = append(params, num)
+			num = -1
+		} else {
+			final = c
+			break
+		}
+	}
+	if num >= 0 {
+		params = append(params, num)
+	}
+	g.readbuffer_consume(i + 1)
+	if private {
+		// DECRQM answer: ESC [ ? mode ; n $ y
+		if c, _ := g.readbuffer_peek(0, ESC_TIMEOUT); final == '$' && c == 'y' {
+			g.readbuffer_consume(1)
+			g.out_sync_reply(params)
+		}
+		return 0
+	}
+
+	// xterm: ESC [ 1 ; <mod> x, some send ESC O <mod> x
+	mod := 0
+	if len(params) > 1 {
+		mod = params[1]
+	} else if c1 == 'O' && len(params) == 1 {
+		mod = params[0]
+	}
+	if mod > 1 {
+		if (mod-1)&1 != 0 {
+			mods |= KEYCODE_SHIFT
+		}
+		if (mod-1)&2 != 0 {
+			mods |= KEYCODE_ALT
+		}
+		if (mod-1)&4 != 0 {
+			mods |= KEYCODE_CTRL
+		}
+	}
+
+	key := 0
+	switch final {
+	case 'A':
+		key = KEYCODE_UP
+	case 'B':
+		key = KEYCODE_DOWN
+	case 'C':
+		key = KEYCODE_RIGHT
+	case 'D':
+		key = KEYCODE_LEFT
+	case 'H':
+		key = KEYCODE_HOME
+	case 'F':
+		key = KEYCODE_END
+	case 'a', 'b', 'c', 'd':
+		// rxvt: ESC [ a = shift-up, ESC O a = ctrl-up
+		key = []int{KEYCODE_UP, KEYCODE_DOWN, KEYCODE_RIGHT, KEYCODE_LEFT}[final-'a']
+		mods |= TernaryInt(c1 == '[', KEYCODE_SHIFT, KEYCODE_CTRL)
+	case '~', '$', '^', '@':
+		if c1 != '[' || len(params) == 0 {
+			return 0
+		}
+		switch params[0] {
+		case 1, 7: // 7: rxvt
+			key = KEYCODE_HOME
+		case 2:
+			key = KEYCODE_INSERT
+		case 3:
+			key = KEYCODE_DELETE
+		case 4, 8: // 8: rxvt
+			key = KEYCODE_END
+		case 5:
+			key = KEYCODE_PAGEUP
+		case 6:
+			key = KEYCODE_PAGEDOWN
+		default:
+			return 0 // function keys
+		}
+		// rxvt: $ = shift, ^ = ctrl, @ = ctrl-shift
+		if final == '$' || final == '@' {
+			mods |= KEYCODE_SHIFT
+		}
+		if final == '^' || final == '@' {
+			mods |= KEYCODE_CTRL
+		}
+	default:
+		return 0
+	}
+	return key &^ mods
+}
@@ -0,0 +1,157 @@
+package main
+
+//----- Marks and the jump list --------------------------------
+//  m{a-z}   set a mark at the cursor
+//  'x `x    go to the line / the char of mark x
+//  ''       where the last jump started
+//  '.       the last change
+//  '[ ']    start and end of the text last changed, yanked or put
+//  '< '>    start and end of the last visual selection
+// Marks are text offsets. mark_insert and mark_delete keep them,
+// the jump list, the last selection and the cursors of other windows
+// on the buffer on their text as it changes.
+// A jump (G / n % H '' and so on) puts where it came from on the
+// jump list, ctrl-O and ctrl-I go back and forth along it.
+const MAX_JUMPS = 100
+
+func valid_mark_name(c int) bool {
+	return (c >= 'a' && c <= 'z') || c == '\'' || c == '`' ||
+		c == '.' || c == '[' || c == ']' || c == '<' || c == '>'
+}
+
+func (g *globals) mark_set(c int, p int) {
+	if c == '`' {
+		c = '\''
+	}
+	if c == '<' || c == '>' {
+		if g.visual_last_mode == 0 {
+			g.visual_last_mode = 'v'
+		}
+		if c == '<' {
+			g.visual_last_start = p
+		} else {
+			g.visual_last_end = p
+		}
+		return
+	}
+	if g.marks == nil {
+		g.marks = make(map[int]int)
+	}
+	g.marks[c] = p
+}
+
+// position of mark c, -1 if it is not set
+func (g *globals) mark_get(c int) int {
+	if c == '`' {
+		c = '\''
+	}
+	p, ok := g.marks[c]
+	if c == '<' || c == '>' {
+		// the start and end of the last selection
+		ok = g.visual_last_mode != 0
+		p = g.visual_last_start
+		if q := g.visual_last_end; (p > q) == (c == '<') {
+			p = q
+		}
+	}
+	if !ok || !valid_mark_name(c) || g.text.size() == 0 {
+		return -1
+	}
+	return TernaryInt(p >= g.text.size(), g.text.size()-1, p)
+}
+
+// marks after p move on as n bytes are inserted at p
+func (g *globals) mark_insert(p int, n int) {
+	shift := func(m *int) {
+		if *m >= p {
+			*m += n
+		}
+	}
+	for c, m := range g.marks {
+		shift(&m)
+		g.marks[c] = m
+	}
+	for i := range g.jumps {
+		shift(&g.jumps[i])
+	}
+	shift(&g.visual_last_start)
+	shift(&g.visual_last_end)
+	g.win_shift(shift)
+}
+
+// and back as text[p:q] is deleted, marks inside it go to p
+func (g *globals) mark_delete(p int, q int) {
+	shift := func(m *int) {
+		if *m >= q {
+			*m -= q - p
+		} else if *m > p {
+			*m = p
+		}
+	}
+	for c, m := range g.marks {
+		shift(&m)
+		g.marks[c] = m
+	}
+	for i := range g.jumps {
+		shift(&g.jumps[i])
+	}
+	shift(&g.visual_last_start)
+	shift(&g.visual_last_end)
+	g.win_shift(shift)
+}
+
+// '[ and '] around text[p:q] that was changed or yanked
+func (g *globals) mark_changed(p int, q int) {
+	g.mark_set('[', p)
+	g.mark_set(']', TernaryInt(q > p, q-1, p))
+}
+
+// motions that jump: the cursor may go far, so where it was goes
+// on the jump list
+func is_jump(c int) bool {
+	switch c {
+	case 'G', KEY_G - 'g', '/', '?', 'n', 'N', '%', '(', ')', '{', '}',
+		'H', 'M', 'L', '\'', '`':
+		return true
+	}
+	return false
+}
+
+// a jump from p: set '' and put p at the end of the jump list,
+// dropping an older entry for the same line
+func (g *globals) jump_push(p int) {
+	g.mark_set('\'', p)
+	l := g.begin_line(p)
+	j := g.jumps[:0]
+	for _, q := range g.jumps {
+		if g.begin_line(q) != l {
+			j = append(j, q)
+		}
+	}
+	g.jumps = append(j, p)
+	if len(g.jumps) > MAX_JUMPS {
+		g.jumps = g.jumps[len(g.jumps)-MAX_JUMPS:]
+	}
+	g.jump_idx = len(g.jumps)
+}
+
+// ctrl-O (dir < 0) and ctrl-I: go cnt entries back or forth on the
+// jump list. Going back from the end first puts the cursor on it,
+// so ctrl-I can come back.
+func (g *globals) jump_go(dir int, cnt int) {
+	cnt = TernaryInt(cnt < 1, 1, cnt)
+	if dir < 0 && g.jump_idx >= len(g.jumps) {
+		g.jump_push(g.dot)
+		g.jump_idx = len(g.jumps) - 1
+	}
+	i := g.jump_idx + dir*cnt
+	if i < 0 || i >= len(g.jumps) {
+		g.key_failed = true
+		return
+	}
+	g.jump_idx = i
+	g.dot = g.jumps[i]
+	if g.dot >= g.text.size() {
+		g.dot = TernaryInt(g.text.size() > 0, g.text.size()-1, 0)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Kinds of motion, as returned by do_motion
+const (
+	MOTION_NONE      = iota // the key is not a motion
+	MOTION_FAILED           // a motion that could not move
+	MOTION_EXCLUSIVE        // char range, the char at the end is not included
+	MOTION_INCLUSIVE        // char range including the char at the end
+	MOTION_LINEWISE         // whole lines
+)
+
+// "g" commands are two keys. do_cmd and do_motion get them as one
+// code below the KEYCODE_xxx range: KEY_G - 'g' for "gg" and so on.
+const KEY_G = -0x1000
+
+//----- Operators: d c y < > ------------------------------------
+// An operator is followed by a motion, or by itself for whole lines
+// (dd, cc, yy, >>, <<). Counts before the operator and before the
+// motion multiply: 2d3w deletes 6 words.
+func (g *globals) do_operator(op int) {
+	cnt := g.cmdcnt
+	c := g.get_one_char()
+	mcnt := 0
+	for (c >= '1' && c <= '9') || (c == '0' && mcnt > 0) {
+		mcnt = mcnt*10 + (c - '0')
+		c = g.get_one_char()
+	}
+	if n := len(strconv.Itoa(mcnt)); mcnt > 0 && g.visual_mode == 0 && len(g.cmd_keys) > n {
+		// . keeps this count apart too
+		k := g.cmd_keys
+		g.cmd_keys = append(k[:len(k)-1-n], k[len(k)-1])
+		g.change_mcnt = mcnt
+	}
+	if cnt > 0 || mcnt > 0 {
+		cnt = TernaryInt(cnt < 1, 1, cnt) * TernaryInt(mcnt < 1, 1, mcnt)
+	}
+	if c == 'g' {
+		c = KEY_G - g.get_one_char()
+	}
+	if c == op {
+		q := g.dot
+		for i := 1; i < cnt; i++ {
+			q = g.next_line(q)
+		}
+		g.op_apply(op, g.dot, q, MOTION_LINEWISE)
+		return
+	}
+	if op == 'c' && (c == 'w' || c == 'W') && g.char_class(g.dot, c == 'W') != 0 {
+		// cw on a word changes to its end, like ce, and keeps the blanks after it
+		big := c == 'W'
+		q := g.dot
+		for n := g.next_rune(q); n < g.text.size() && g.char_class(n, big) == g.char_class(q, big); n = g.next_rune(n) {
+			q = n
+		}
+		for i := 1; i < cnt; i++ {
+			q = g.end_word(q, big)
+		}
+		g.op_apply(op, g.dot, q, MOTION_INCLUSIVE)
+		return
+	}
+
+	save := g.dot
+	g.cmdcnt = cnt
+	g.op_pending = true
+	kind := g.do_motion(c)
+	g.op_pending = false
+	q := g.dot
+	g.dot = save
+	if kind == MOTION_NONE || kind == MOTION_FAILED {
+		g.key_failed = kind == MOTION_FAILED
+		return
+	}
+	g.op_apply(op, save, q, kind)
+}
+
+// op_apply runs operator op over the text between p and q
+func (g *globals) op_apply(op int, p, q int, kind int) {
+	start, stop := p, q
+	if start > stop {
+		start, stop = stop, start
+	}
+	if kind == MOTION_INCLUSIVE {
+		stop = g.next_rune(stop)
+	}
+	if kind == MOTION_EXCLUSIVE && stop > start && g.begin_line(stop) == stop &&
+		g.count_lines(start, stop) > 0 {
+		// an exclusive motion ending in column 0 stops at the end
+		// of the line before; from the start of a line it is linewise
+		if g.first_nonblank(start) >= start {
+			stop = g.prev_line(stop)
+			kind = MOTION_LINEWISE
+		} else {
+			stop--
+		}
+	}
+	if kind == MOTION_LINEWISE {
+		start = g.begin_line(start)
+		stop = g.next_line(stop)
+	}
+	stop = TernaryInt(stop > g.text.size(), g.text.size(), stop)
+	if stop == start {
+		return
+	}
+	lines := g.count_lines(start, stop) // lines touched
+	if stop == start || g.text.at(stop-1) != '\n' {
+		lines++
+	}
+
+	switch op {
+	case 'y':
+		g.reg_store(op, g.text.copy_out(start, stop), kind == MOTION_LINEWISE)
+		g.mark_changed(start, stop)
+		if kind != MOTION_LINEWISE {
+			g.dot = start
+		} else if q < p {
+			g.dot = q
+		}
+		g.report_lines(lines, "yanked")
+	case 'd':
+		g.reg_store(op, g.text.copy_out(start, stop), kind == MOTION_LINEWISE)
+		g.string_delete(start, stop)
+		g.dot = start
+		if kind == MOTION_LINEWISE {
+			if g.dot >= g.text.size() && g.dot > 0 {
+				g.dot = g.begin_line(g.dot - 1)
+			}
+			g.dot_skip_over_ws()
+		}
+		g.report_lines(lines, "deleted")
+	case 'c':
+		g.reg_store(op, g.text.copy_out(start, stop), kind == MOTION_LINEWISE)
+		if kind == MOTION_LINEWISE && stop > start && g.text.at(stop-1) == '\n' {
+			stop-- // keep one empty line to type into
+		}
+		g.string_delete(start, stop)
+		g.dot = start
+		g.cmd_mode = 1
+	case '<', '>':
+		l := g.begin_line(start)
+		for i := 0; i < lines; i++ {
+			g.shift_line(l, TernaryInt(op == '>', 1, -1))
+			l = g.next_line(l)
+		}
+		g.dot = g.begin_line(start)
+		g.dot_skip_over_ws()
+		g.report_lines(lines, string(rune(op))+"ed 1 time")
+	}
+}
+
+// report a change of many lines on the status line
+func (g *globals) report_lines(n int, what string) {
+	if n > 2 {
+		g.status_line("%d lines %s", n, what)
+	}
+}
+
+// first non-blank char of the line p is on
+func (g *globals) first_nonblank(p int) int {
+	p = g.begin_line(p)
+	for c := g.text.at(p); (c == ' ' || c == '\t') && p < g.text.size(); c = g.text.at(p) {
+		p++
+	}
+	return p
+}
+
+// move cnt chars from p to the right (dir > 0) or left, but not
+// off the line. To the right the end may be the '\n' itself.
+func (g *globals) char_span(p int, cnt int, dir int) int {
+	for ; cnt > 0; cnt-- {
+		if dir > 0 {
+			if p >= g.text.size() || g.text.at(p) == '\n' {
+				break
+			}
+			p = g.next_rune(p)
+		} else {
+			if p <= 0 || g.text.at(p-1) == '\n' {
+				break
+			}
+			p = g.prev_rune(p)
+		}
+	}
+	return p
+}
+
+// shift the line at p one shiftwidth to the right (dir > 0) or left
+func (g *globals) shift_line(p int, dir int) {
+	if e := g.first_nonblank(p); dir > 0 && (e >= g.text.size() || g.text.at(e) == '\n') {
+		return // leave empty lines alone
+	}
+	g.shift_indent(p, dir)
+}
+
+// change the indent of the line at p by one shiftwidth, even if the
+// line is empty (ctrl-T in insert mode)
+func (g *globals) shift_indent(p int, dir int) {
+	b := g.begin_line(p)
+	e := b
+	col := 0
+	for ; e < g.text.size(); e++ {
+		c := g.text.at(e)
+		if c == ' ' {
+			col++
+		} else if c == '\t' {
+			col = g.next_tabstop(col) + 1
+		} else {
+			break
+		}
+	}
+	col += dir * g.shiftwidth
+	col = TernaryInt(col < 0, 0, col)
+	indent := strings.Repeat("\t", col/g.tabstop) + strings.Repeat(" ", col%g.tabstop)
+	if indent != string(g.text.copy_out(b, e)) {
+		g.string_delete(b, e)
+		g.string_insert(b, []byte(indent))
+	}
+}
+
+// join n lines starting with the line at p. With spaces the
+// blanks at the start of each joined line become one space
+// (none before ')' or after a blank), otherwise they stay.
+func (g *globals) join_lines(p int, n int, spaces bool) {
+	for ; n > 1; n-- {
+		e := g.end_line(p)
+		if e >= g.text.size()-1 {
+			break // no line after it
+		}
+		q := e + 1
+		if spaces {
+			for c := g.text.at(q); c == ' ' || c == '\t'; c = g.text.at(q) {
+				q++
+			}
+		}
+		g.string_delete(e, q)
+		g.dot = e
+		if c := g.text.at(e); spaces && c != '\n' && c != ')' && e > 0 &&
+			g.text.at(e-1) != '\n' && g.text.at(e-1) != ' ' && g.text.at(e-1) != '\t' {
+			g.string_insert(e, []byte{' '})
+		}
+	}
+}
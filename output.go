@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/* Hide/show the cursor while a frame is drawn */
+const ESC_HIDE_CURSOR = ESC + "[?25l"
+const ESC_SHOW_CURSOR = ESC + "[?25h"
+
+/* Synchronized update: the terminal shows the frame once it ends.
+ * Whether it knows the mode is asked with DECRQM, the answer is
+ * "ESC [ ? 2026 ; <n> $ y", n = 1..4 if it does.
+ */
+const ESC_SYNC_BEGIN = ESC + "[?2026h"
+const ESC_SYNC_END = ESC + "[?2026l"
+const ESC_SYNC_QUERY = ESC + "[?2026$p"
+const SYNC_MODE = 2026
+
+//----- Terminal output ------------------------------------------
+// Everything for the terminal is collected in a frame and sent
+// with one write by out_flush, when the editor waits for a key.
+type term_output struct {
+	frame       bytes.Buffer
+	hide_cursor bool // hide the cursor while the frame is drawn
+	sync        bool // the terminal does synchronized updates
+}
+
+func (g *globals) out_printf(f string, a ...interface{}) {
+	fmt.Fprintf(&g.out.frame, f, a...)
+}
+
+// send the frame to the terminal
+func (g *globals) out_flush() {
+	o := &g.out
+	if o.frame.Len() == 0 {
+		return
+	}
+	var b bytes.Buffer
+	if o.sync {
+		b.WriteString(ESC_SYNC_BEGIN)
+	}
+	if o.hide_cursor {
+		b.WriteString(ESC_HIDE_CURSOR)
+	}
+	b.Write(o.frame.Bytes())
+	if o.hide_cursor {
+		b.WriteString(ESC_SHOW_CURSOR)
+	}
+	if o.sync {
+		b.WriteString(ESC_SYNC_END)
+	}
+	o.frame.Reset()
+	g.term.write(b.Bytes())
+}
+
+// the answer to ESC_SYNC_QUERY, read as a key sequence
+func (g *globals) out_sync_reply(params []int) {
+	if len(params) == 2 && params[0] == SYNC_MODE {
+		g.out.sync = params[1] >= 1 && params[1] <= 3 // 4: permanently off
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// A register holds yanked or deleted text
+type register struct {
+	text     []byte
+	linewise bool // whole lines, always ending in '\n'
+	block    bool // the lines of a visual block, put as a column
+}
+
+//----- Registers ----------------------------------------------
+//  "a - "z  named, "A - "Z append to them
+//  "0       last yank
+//  "1 - "9  last deletes of whole or several lines, "1 newest
+//  "-       last delete within one line
+//  ""       unnamed: whichever register was written last
+const (
+	REG_NUMBERED = 26
+	REG_SMALL    = 36
+	REG_COUNT    = 37
+)
+
+// index of register name c in g.regs, or -1
+func reg_index(c int) int {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return c - 'a'
+	case c >= 'A' && c <= 'Z':
+		return c - 'A'
+	case c >= '0' && c <= '9':
+		return REG_NUMBERED + c - '0'
+	case c == '-':
+		return REG_SMALL
+	}
+	return -1
+}
+
+func reg_name(i int) byte {
+	switch {
+	case i < REG_NUMBERED:
+		return byte('a' + i)
+	case i < REG_SMALL:
+		return byte('0' + i - REG_NUMBERED)
+	}
+	return '-'
+}
+
+func valid_reg_name(c int) bool {
+	return c == '"' || reg_index(c) >= 0
+}
+
+// the register named c, "" or 0 for the unnamed one
+func (g *globals) reg_get(c int) *register {
+	if c == 0 || c == '"' {
+		return &g.regs[g.reg_unnamed]
+	}
+	if i := reg_index(c); i >= 0 {
+		return &g.regs[i]
+	}
+	return nil
+}
+
+// reg_store saves text yanked (op 'y') or deleted by a command,
+// into the register selected with "x or the default ones.
+func (g *globals) reg_store(op int, text []byte, linewise bool) {
+	if linewise && (len(text) == 0 || text[len(text)-1] != '\n') {
+		text = append(text, '\n')
+	}
+	name := g.cur_reg
+	if name != 0 && name != '"' {
+		i := reg_index(name)
+		r := &g.regs[i]
+		if unicode.IsUpper(rune(name)) && len(r.text) > 0 { // "A appends to "a
+			if linewise && !r.linewise {
+				r.text = append(r.text, '\n')
+			}
+			r.text = append(r.text, text...)
+			r.linewise = r.linewise || linewise
+		} else {
+			*r = register{text: text, linewise: linewise}
+		}
+		g.reg_unnamed = i
+		return
+	}
+	switch {
+	case op == 'y':
+		g.reg_unnamed = REG_NUMBERED
+	case linewise || bytes.IndexByte(text, '\n') >= 0:
+		copy(g.regs[REG_NUMBERED+2:REG_SMALL], g.regs[REG_NUMBERED+1:REG_SMALL-1])
+		g.reg_unnamed = REG_NUMBERED + 1
+	default:
+		g.reg_unnamed = REG_SMALL
+	}
+	g.regs[g.reg_unnamed] = register{text: text, linewise: linewise}
+}
+
+// reg_store_block saves the lines of a block yanked or deleted
+func (g *globals) reg_store_block(op int, lines [][]byte) {
+	g.reg_store(op, bytes.Join(lines, []byte{'\n'}), false)
+	g.regs[g.reg_unnamed].block = true
+}
+
+//----- p/P: put a register after/before the cursor ------------
+func (g *globals) put(name int, after bool, cnt int) {
+	r := g.reg_get(name)
+	if r == nil || len(r.text) == 0 {
+		g.status_line_bold("Nothing in register %c", TernaryInt(name == 0, '"', name))
+		return
+	}
+	cnt = TernaryInt(cnt < 1, 1, cnt)
+	if r.block {
+		g.put_block(r, after, cnt)
+		return
+	}
+	if r.linewise {
+		p := g.begin_line(g.dot)
+		if after {
+			p = g.put_line_pos(g.dot)
+		}
+		for i := 0; i < cnt; i++ {
+			g.string_insert(p, r.text)
+		}
+		g.dot = p
+		g.dot_skip_over_ws()
+		g.report_lines(cnt*bytes.Count(r.text, []byte{'\n'}), "added")
+		return
+	}
+	p := g.dot
+	if after && g.text.at(p) != '\n' && p < g.text.size() {
+		p = g.next_rune(p)
+	}
+	for i := 0; i < cnt; i++ {
+		p = g.string_insert(p, r.text)
+	}
+	g.dot = g.prev_rune(p) // on the last char put
+}
+
+// put a block: its lines go into the lines from the cursor down, at
+// the cursor column. Lines are added at the end of the text if needed
+// and short lines padded with spaces.
+func (g *globals) put_block(r *register, after bool, cnt int) {
+	col := g.col_of(g.dot)
+	if c, _ := g.text.rune_at(g.dot); after && c != '\n' && g.dot < g.text.size() {
+		col = g.col_after(c, col)
+	}
+	lines := bytes.Split(r.text, []byte{'\n'})
+	width := 0
+	for _, l := range lines {
+		if w := g.text_width(l); w > width {
+			width = w
+		}
+	}
+	l := g.begin_line(g.dot)
+	first := -1
+	for i, s := range lines {
+		if i > 0 {
+			if l = g.next_line(l); l >= g.text.size() {
+				l = g.put_line_pos(g.text.size())
+				g.string_insert(l, []byte{'\n'})
+			}
+		}
+		p := g.move_to_col(l, col)
+		at_eol := g.text.at(p) == '\n' || p >= g.text.size()
+		if co := g.col_of(p); co < col {
+			if len(s) == 0 {
+				continue
+			}
+			p = g.string_insert(p, bytes.Repeat([]byte{' '}, col-co))
+		}
+		var text []byte
+		for j := 0; j < cnt; j++ {
+			text = append(text, s...)
+			if j < cnt-1 || !at_eol {
+				text = append(text, bytes.Repeat([]byte{' '}, width-g.text_width(s))...)
+			}
+		}
+		g.string_insert(p, text)
+		if i == 0 {
+			first = p
+		}
+	}
+	if first >= 0 {
+		g.dot = first
+	}
+}
+
+// number of screen columns b takes, starting at column 0
+func (g *globals) text_width(b []byte) int {
+	co := 0
+	for _, c := range string(b) {
+		co = g.col_after(c, co)
+	}
+	return co
+}
+
+// where lines put after the line at p go. The text is made
+// to end in '\n' first if it does not.
+func (g *globals) put_line_pos(p int) int {
+	q := g.next_line(p)
+	if q == g.text.size() && q > 0 && g.text.at(q-1) != '\n' {
+		q = g.string_insert(q, []byte{'\n'})
+	}
+	return q
+}
+
+//----- :put - put a register as lines below/above the cursor line
+func (g *globals) ex_put(name int, above bool) {
+	r := g.reg_get(name)
+	if r == nil || len(r.text) == 0 {
+		g.status_line_bold("Nothing in register %c", TernaryInt(name == 0, '"', name))
+		return
+	}
+	text := r.text
+	if !r.linewise {
+		text = append(append([]byte(nil), text...), '\n')
+	}
+	p := g.begin_line(g.dot)
+	if !above {
+		p = g.put_line_pos(g.dot)
+	}
+	q := g.string_insert(p, text)
+	g.dot = g.begin_line(q - 1) // the last line put
+	g.dot_skip_over_ws()
+}
+
+// :registers - list the registers that hold something
+func (g *globals) show_registers(names string) {
+	lines := []string{"--- Registers ---"}
+	show := func(name byte, r *register) {
+		if len(r.text) == 0 {
+			return
+		}
+		if names != "" && strings.IndexByte(names, name) < 0 {
+			return
+		}
+		lines = append(lines, fmt.Sprintf("\"%c   %s", name, visible_text(r.text, g.columns-5)))
+	}
+	show('"', &g.regs[g.reg_unnamed])
+	for i := REG_NUMBERED; i < REG_SMALL; i++ {
+		show(reg_name(i), &g.regs[i])
+	}
+	for i := 0; i < REG_NUMBERED; i++ {
+		show(reg_name(i), &g.regs[i])
+	}
+	show('-', &g.regs[REG_SMALL])
+	g.show_lines(lines)
+}
+
+// text for display on one line: control chars as ^X, cut to width cells
+func visible_text(b []byte, width int) string {
+	var out []rune
+	w := 0
+	for _, r := range string(b) {
+		if r < ' ' || r == 0x7f {
+			out = append(out, '^', TernaryRune(r == 0x7f, '?', r+'@'))
+			w += 2
+		} else {
+			out = append(out, r)
+			w += RuneWidth(r)
+		}
+		if w >= width {
+			break
+		}
+	}
+	return string(out)
+}
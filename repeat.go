@@ -0,0 +1,164 @@
+package main
+
+import "strconv"
+
+//----- Repeat: . ----------------------------------------------
+// Every key get_one_char returns goes to g.cmd_keys. A command
+// typed in command mode starts it again, and when the command (and
+// the insert it started) is over and changed the text, its keys
+// become the last change. The counts before the command and before
+// its motion are kept apart, so "3." can replace them. Ex commands and undo are not repeated.
+
+// a key for do_cmd in command mode: a new command starts unless it
+// comes after a count, a "x or inside visual mode
+func (g *globals) change_begin(c int) {
+	g.change_cnt = g.cmdcnt
+	if g.cmdcnt == 0 && g.cur_reg == 0 && g.visual_mode == 0 && !g.dot_replay {
+		g.cmd_keys = append(g.cmd_keys[:0], c)
+		g.cmd_changes = g.changes
+		g.change_mcnt = 0
+	}
+}
+
+// the command is done when back in command mode
+func (g *globals) change_end() {
+	if g.cmd_mode != 0 || g.visual_mode != 0 || g.dot_replay || g.changes == g.cmd_changes ||
+		len(g.cmd_keys) == 0 || g.cmd_keys[0] == ':' || g.cmd_keys[0] == '.' {
+		return
+	}
+	g.last_change = append(g.last_change[:0], g.cmd_keys...)
+	g.last_change_cnt, g.last_change_mcnt = g.change_cnt, g.change_mcnt
+	g.cmd_changes = g.changes
+}
+
+// .- type the keys of the last change again, with the count of
+// the . if it has one
+func (g *globals) dot_repeat() {
+	if len(g.last_change) == 0 || g.dot_replay {
+		return
+	}
+	if g.cmdcnt > 0 { // replaces both counts, d3w 2. deletes 2 words
+		g.last_change_cnt, g.last_change_mcnt = g.cmdcnt, 0
+	}
+	cnt, mcnt := g.last_change_cnt, g.last_change_mcnt
+	if mcnt > 0 { // they multiply, 2d3w is 6dw
+		cnt = TernaryInt(cnt < 1, 1, cnt) * mcnt
+	}
+	var keys []int
+	if cnt > 0 {
+		for _, d := range strconv.Itoa(cnt) {
+			keys = append(keys, int(d))
+		}
+	}
+	keys = append(keys, g.last_change...)
+	g.cmdcnt, g.cur_reg = 0, 0
+
+	g.dot_replay = true
+	g.run_keys(keys, true)
+	g.dot_replay = false
+}
+
+// run_keys feeds keys to do_cmd before the keys still queued, which
+// are those after the current one when :normal or a macro runs.
+// With esc an unfinished insert or command ends as if ESC followed.
+// A failed motion drops the keys that are left.
+func (g *globals) run_keys(keys []int, esc bool) {
+	rest := len(g.ioq)
+	g.ioq = append(keys, g.ioq...)
+	save := g.ioq_esc
+	g.ioq_esc = g.ioq_esc || esc
+	g.key_failed = false
+	for len(g.ioq) > rest && g.editing != 0 {
+		g.do_cmd(g.get_one_char())
+		if g.key_failed {
+			g.ioq = g.ioq[TernaryInt(len(g.ioq) > rest, len(g.ioq)-rest, 0):]
+			break
+		}
+	}
+	if esc && g.cmd_mode != 0 {
+		g.do_cmd(27)
+	}
+	g.ioq_esc = save
+}
+
+//----- Macros: q @ --------------------------------------------
+// q{reg} records the keys typed until the next q into a register,
+// q{REG} appends to it. @{reg} types them again, @@ repeats the last
+// @, 3@a runs it three times. Keys are kept in the register as UTF-8,
+// function keys (below 0) as runes at the top of the unicode range.
+const MACRO_KEY_BASE = 0x10ff00
+
+func keys_to_bytes(keys []int) []byte {
+	var b []byte
+	for _, k := range keys {
+		if k < 0 {
+			k = MACRO_KEY_BASE + k&0xff
+		}
+		b = append(b, RuneToBytes(rune(k))...)
+	}
+	return b
+}
+
+func bytes_to_keys(b []byte) []int {
+	var keys []int
+	for _, r := range string(b) {
+		k := int(r)
+		if k >= MACRO_KEY_BASE {
+			k = k - MACRO_KEY_BASE - 0x100
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// q{reg} starts recording, q stops it
+func (g *globals) macro_record() {
+	if g.recording != 0 {
+		keys := g.rec_keys[:len(g.rec_keys)-1] // not the q
+		r := g.reg_get(g.recording)
+		if g.recording >= 'A' && g.recording <= 'Z' {
+			r.text = append(r.text, keys_to_bytes(keys)...)
+		} else {
+			r.text = keys_to_bytes(keys)
+		}
+		r.linewise, r.block = false, false
+		g.recording = 0
+		g.go_bottom_and_clear_to_eol()
+		return
+	}
+	c := g.get_one_char()
+	if !valid_reg_name(c) {
+		return
+	}
+	g.recording = c
+	g.rec_keys = g.rec_keys[:0]
+}
+
+// @{reg}- run the keys in a register cnt times
+func (g *globals) macro_play(cnt int) {
+	c := g.get_one_char()
+	if c == '@' {
+		c = g.last_macro
+	}
+	if c == 0 {
+		g.status_line_bold("No previously used register")
+		return
+	}
+	r := g.reg_get(c)
+	if r == nil {
+		return
+	}
+	g.last_macro = c
+	var keys []int
+	for i := TernaryInt(cnt < 1, 1, cnt); i > 0; i-- {
+		keys = append(keys, bytes_to_keys(r.text)...)
+	}
+	g.cmdcnt = 0
+	if g.macro_running { // @a in a macro: queue the keys
+		g.ioq = append(keys, g.ioq...)
+		return
+	}
+	g.macro_running = true
+	g.run_keys(keys, false)
+	g.macro_running = false
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//----- Search: / ? n N -----------------------------------------
+// Patterns are POSIX vi regular expressions (basic regular expressions):
+//  ^ $      start and end of a line, at the start/end of the pattern
+//  . * []   any char, repeat, bracket expression
+//  \< \>    start and end of a word
+//  \( \)    group, \{n,m\} interval
+// + ? | ( ) { } are plain chars. vi_regexp translates them for package regexp.
+// Package regexp only sees the text from where a search starts and
+// its \b knows only ASCII words, so ^ \< \> are marked with an empty
+// group and checked against the chars around the match (match_ok).
+// A search may be followed by an offset after the closing / or ?:
+//  [+-]N    N lines down/up, the motion is linewise
+//  e[+-N]   N chars from the end of the match
+//  s[+-N]   N chars from the start (b works too)
+
+// a compiled vi pattern
+type vi_re struct {
+	re    *regexp.Regexp
+	marks []byte // per group: 0 for \( \), or the ^ < > it marks
+}
+
+// vi_regexp compiles a vi pattern
+func vi_regexp(pat string) (*vi_re, error) {
+	var b strings.Builder
+	b.WriteString("(?m)")
+	marks := []byte{0} // group 0 is the whole match
+	mark := func(c byte) {
+		b.WriteString("()")
+		marks = append(marks, c)
+	}
+	bracket := false // inside [...]
+	for i := 0; i < len(pat); i++ {
+		c := pat[i]
+		if bracket {
+			switch {
+			case c == ']' && pat[i-1] != '[' && !(pat[i-1] == '^' && pat[i-2] == '['):
+				bracket = false
+				b.WriteByte(c)
+			case c == '\\': // a plain char in POSIX brackets
+				b.WriteString(`\\`)
+			case c == '[' && i+1 < len(pat) && (pat[i+1] == ':' || pat[i+1] == '.' || pat[i+1] == '='):
+				// [:alpha:] and the like are copied up to the closing ]
+				if e := strings.Index(pat[i+2:], string(pat[i+1])+"]"); e >= 0 {
+					b.WriteString(pat[i : i+e+4])
+					i += e + 3
+				} else {
+					b.WriteString(`\[`)
+				}
+			case c == '[':
+				b.WriteString(`\[`)
+			default:
+				b.WriteByte(c)
+			}
+			continue
+		}
+		switch c {
+		case '[':
+			bracket = true
+			b.WriteByte(c)
+		case '^':
+			if i == 0 || strings.HasSuffix(pat[:i], `\(`) || strings.HasSuffix(pat[:i], `\|`) {
+				b.WriteByte(c)
+				mark(c)
+			} else {
+				b.WriteString(`\^`)
+			}
+		case '$':
+			if i == len(pat)-1 || strings.HasPrefix(pat[i+1:], `\)`) || strings.HasPrefix(pat[i+1:], `\|`) {
+				b.WriteByte(c)
+			} else {
+				b.WriteString(`\$`)
+			}
+		case '*':
+			if i == 0 || strings.HasSuffix(pat[:i], `\(`) || (i == 1 && pat[0] == '^') {
+				b.WriteString(`\*`)
+			} else {
+				b.WriteByte(c)
+			}
+		case '+', '?', '|', '(', ')', '{', '}':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\\':
+			i++
+			if i == len(pat) {
+				b.WriteString(`\\`)
+				break
+			}
+			switch c = pat[i]; c {
+			case '<', '>':
+				mark(c)
+			case '(':
+				b.WriteByte(c)
+				marks = append(marks, 0)
+			case ')', '{', '}', '|', '+', '?':
+				b.WriteByte(c)
+			case 'n':
+				b.WriteString(`\n`)
+			case 't':
+				b.WriteString(`\t`)
+			case 'd', 'D', 's', 'S', 'w', 'W':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			default:
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if bracket {
+		return nil, strconv.ErrSyntax
+	}
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+	return &vi_re{re, marks}, nil
+}
+
+// a word char for \< and \>, the same as for the w motion
+func is_word_rune(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// match_ok checks the marked ^ \< \> of match m against the chars
+// before and after them in text
+func (re *vi_re) match_ok(text []byte, m []int) bool {
+	for i, c := range re.marks {
+		q := m[2*i]
+		if c == 0 || q < 0 {
+			continue
+		}
+		before, after := false, false
+		if q > 0 {
+			r, _ := utf8.DecodeLastRune(text[:q])
+			before = is_word_rune(r)
+		}
+		if q < len(text) {
+			r, _ := utf8.DecodeRune(text[q:])
+			after = is_word_rune(r)
+		}
+		switch {
+		case c == '^' && q > 0 && text[q-1] != '\n',
+			c == '<' && (before || !after),
+			c == '>' && (!before || after):
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the first match in text that starts at or after from,
+// as the start and end of the match and of each \( \) group, or nil
+func (re *vi_re) find(text []byte, from int) []int {
+	for from <= len(text) {
+		m := re.re.FindSubmatchIndex(text[from:])
+		if m == nil {
+			return nil
+		}
+		for i := range m {
+			if m[i] >= 0 {
+				m[i] += from
+			}
+		}
+		if re.match_ok(text, m) {
+			groups := m[:2]
+			for i, c := range re.marks[1:] {
+				if c == 0 {
+					groups = append(groups, m[2*i+2], m[2*i+3])
+				}
+			}
+			return groups
+		}
+		_, size := utf8.DecodeRune(text[m[0]:])
+		from = m[0] + TernaryInt(size == 0, 1, size)
+	}
+	return nil
+}
+
+// find_all returns up to n (all if n < 0) matches that do not
+// overlap, like regexp's FindAllSubmatchIndex
+func (re *vi_re) find_all(text []byte, n int) [][]int {
+	var all [][]int
+	prev := -1 // end of the last non-empty match
+	for p := 0; p <= len(text) && (n < 0 || len(all) < n); {
+		m := re.find(text, p)
+		if m == nil {
+			break
+		}
+		p = m[1]
+		if m[0] == m[1] {
+			_, size := utf8.DecodeRune(text[p:])
+			p += TernaryInt(size == 0, 1, size)
+			if m[0] == prev {
+				continue // an empty match right after a match
+			}
+		} else {
+			prev = m[1]
+		}
+		all = append(all, m)
+	}
+	return all
+}
+
+// split the text typed after / or ? into the pattern and the
+// offset. \/ in a / search (\? in a ? search) is the char itself.
+func search_split(s string, delim byte) (pat string, off string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			if s[i+1] == delim {
+				if delim == '?' { // \? would mean "optional"
+					b.WriteString(`[?]`)
+				} else {
+					b.WriteByte(delim)
+				}
+			} else {
+				b.WriteByte(c)
+				b.WriteByte(s[i+1])
+			}
+			i++
+			continue
+		}
+		if c == delim {
+			return b.String(), s[i+1:]
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), ""
+}
+
+// char_search finds the next match of re starting after p (dir > 0)
+// or the previous one starting before p, wrapping around the end of
+// the text. It returns the start and end of the match, or -1, and
+// whether it wrapped.
+func (g *globals) char_search(p int, re *vi_re, dir int) (int, int, bool) {
+	size := g.text.size()
+	text := g.text.slice(0, size)
+	if dir > 0 {
+		if p < size {
+			if m := re.find(text, g.next_rune(p)); m != nil {
+				return m[0], m[1], false
+			}
+		}
+		if m := re.find(text, 0); m != nil {
+			return m[0], m[1], true
+		}
+		return -1, -1, false
+	}
+	// walk the matches from the top, each one starting a char after
+	// the last, up to p, or to the end of the text to wrap around
+	var before, last []int
+	for m := re.find(text, 0); m != nil; m = re.find(text, g.next_rune(m[0])) {
+		if m[0] >= p && before != nil {
+			break
+		}
+		if m[0] < p {
+			before = m
+		}
+		last = m
+		if m[0] >= size {
+			break
+		}
+	}
+	if before != nil {
+		return before[0], before[1], false
+	}
+	if last != nil {
+		return last[0], last[1], true
+	}
+	return -1, -1, false
+}
+
+// do_search moves dot to the cnt'th match of the last search pattern,
+// dir > 0 in the direction it was typed, applying the search offset.
+// It returns the kind of motion, MOTION_FAILED if nothing matched.
+func (g *globals) do_search(dir int, cnt int) int {
+	if g.last_search_pattern == "" {
+		g.status_line_bold("No previous regular expression")
+		return MOTION_FAILED
+	}
+	re, err := vi_regexp(g.last_search_pattern)
+	if err != nil {
+		g.status_line_bold("Invalid pattern: %s", g.last_search_pattern)
+		return MOTION_FAILED
+	}
+	dir *= g.last_search_dir
+	off := g.last_search_offset
+	kind := MOTION_EXCLUSIVE
+	n := 0
+	if len(off) > 0 && strings.IndexByte("esb", off[0]) >= 0 {
+		if off[0] == 'e' {
+			kind = MOTION_INCLUSIVE
+		}
+		n = search_offset_num(off[1:])
+		off = off[:1]
+	} else if off != "" {
+		kind = MOTION_LINEWISE
+		n = search_offset_num(off)
+	}
+
+	// where the cursor goes for a match
+	target := func(start, end int) int {
+		p := start
+		if kind == MOTION_LINEWISE {
+			l := g.begin_line(p)
+			for i := n; i > 0; i-- {
+				l = g.next_line(l)
+			}
+			for i := n; i < 0; i++ {
+				l = g.prev_line(l)
+			}
+			return g.first_nonblank(l)
+		}
+		if off == "e" && end > start {
+			p = g.prev_rune(end)
+		}
+		for i := n; i > 0 && p < g.text.size(); i-- {
+			p = g.next_rune(p)
+		}
+		for i := n; i < 0 && p > 0; i++ {
+			p = g.prev_rune(p)
+		}
+		return p
+	}
+
+	p := g.dot
+	start, end := -1, -1
+	wrapped, retried := false, false
+	for i := 0; i < cnt; i++ {
+		s, e, w := g.char_search(p, re, dir)
+		if s < 0 {
+			g.status_line_bold("Pattern not found: %s", g.last_search_pattern)
+			return MOTION_FAILED
+		}
+		start, end, p = s, e, s
+		wrapped = wrapped || w
+		if i == 0 && !retried && target(start, end) == g.dot {
+			// with an offset the match the cursor came from
+			// can be found again, go on to the next one
+			retried = true
+			i--
+		}
+	}
+	if wrapped && dir > 0 {
+		g.status_line_bold("search hit BOTTOM, continuing at TOP")
+	} else if wrapped {
+		g.status_line_bold("search hit TOP, continuing at BOTTOM")
+	}
+	g.dot = target(start, end)
+	return kind
+}
+
+// "+2", "-", "3" and "" as an offset count
+func search_offset_num(s string) int {
+	switch s {
+	case "":
+		return 0
+	case "+":
+		return 1
+	case "-":
+		return -1
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+//----- Tab pages: :tabnew :tabe gt gT :tabclose :tabs ------------
+// A tab page is a screen of windows of its own. The current one's
+// frames and window are g.frame_root and g.win, the others keep
+// theirs in tab_page. With more than one tab page the top row of
+// the screen shows a line of their names, the windows go below it.
+type tab_page struct {
+	root *frame
+	win  *window
+}
+
+// call fn for each window on every tab page
+func (g *globals) each_window(fn func(w *window)) {
+	for _, t := range g.tabs {
+		if t != g.tab {
+			t.root.each(fn)
+		}
+	}
+	if g.frame_root != nil {
+		g.frame_root.each(fn)
+	}
+}
+
+// the row the windows start on, below the tab line
+func (g *globals) tab_line_rows() int {
+	return TernaryInt(len(g.tabs) > 1, 1, 0)
+}
+
+func (g *globals) tab_index(t *tab_page) int {
+	for i, tt := range g.tabs {
+		if tt == t {
+			return i
+		}
+	}
+	return -1
+}
+
+// keep the current tab page's windows in it, as for the others
+func (g *globals) tab_save() {
+	g.win.dot, g.win.screenbegin = g.dot, g.screenbegin
+	g.tab.root, g.tab.win = g.frame_root, g.win
+}
+
+// make t the current tab page
+func (g *globals) tab_enter(t *tab_page) {
+	if t == g.tab {
+		return
+	}
+	g.tab_save()
+	g.tab = t
+	g.frame_root, g.win = t.root, t.win
+	g.buffer = g.win.buf
+	g.dot, g.screenbegin = g.win.dot, g.win.screenbegin
+	if g.text == nil { // dropped by :q! elsewhere
+		g.init_text_buffer(g.current_filename)
+	}
+	if size := g.text.size(); g.dot >= size {
+		g.dot = TernaryInt(size > 0, size-1, 0)
+	}
+	g.redraw(true)
+}
+
+// :tabnew [file] :tabe[dit] [file]  a new tab page after the current
+// one, with a window on file or an empty buffer
+func (g *globals) tab_new(arg string) {
+	b := g.buffer_find(arg)
+	if b == nil || arg == "" {
+		b = g.buffer_new(arg)
+	}
+	g.tab_save()
+	t := &tab_page{}
+	i := g.tab_index(g.tab) + 1
+	g.tabs = append(g.tabs[:i], append([]*tab_page{t}, g.tabs[i:]...)...)
+	g.tab = t
+	g.win = &window{buf: g.buffer, dot: g.dot, screenbegin: g.screenbegin}
+	g.frame_root = &frame{win: g.win}
+	g.win.frame = g.frame_root
+	g.buffer_switch(b)
+}
+
+// gt (dir > 0) and gT: cnt tab pages on, around the end. N gt
+// goes to tab page N.
+func (g *globals) tab_go(dir int, cnt int) {
+	n := len(g.tabs)
+	i := g.tab_index(g.tab)
+	switch {
+	case dir > 0 && cnt > 0:
+		if cnt > n {
+			return
+		}
+		i = cnt - 1
+	default:
+		i = ((i+dir*TernaryInt(cnt < 1, 1, cnt))%n + n) % n
+	}
+	g.tab_enter(g.tabs[i])
+}
+
+// :tabc[lose][!] [N]  close the current tab page or page N
+func (g *globals) tab_close(arg string, force bool) {
+	if len(g.tabs) < 2 {
+		g.status_line_bold("Cannot close last tab page")
+		return
+	}
+	t := g.tab
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(g.tabs) {
+			g.status_line_bold("Invalid argument: %s", arg)
+			return
+		}
+		t = g.tabs[n-1]
+	}
+	g.tab_save()
+	shown := map[*buffer]int{} // windows of each buffer on the page
+	t.root.each(func(w *window) { shown[w.buf]++ })
+	for b, n := range shown {
+		if !g.buffer_may_hide(b, n, force) {
+			g.status_line_bold("No write since last change (add ! to override)")
+			return
+		}
+	}
+	i := g.tab_index(t)
+	if t == g.tab {
+		next := g.tabs[TernaryInt(i+1 < len(g.tabs), i+1, i-1)]
+		g.tab_enter(next)
+	}
+	g.tabs = append(g.tabs[:i], g.tabs[i+1:]...)
+	g.redraw(true)
+}
+
+// :tabs  the windows of each tab page, > the current window, + for changes
+func (g *globals) tab_list() {
+	var lines []string
+	g.tab_save()
+	for i, t := range g.tabs {
+		lines = append(lines, fmt.Sprintf("Tab page %d", i+1))
+		t.root.each(func(w *window) {
+			name := TernaryString(w.buf.current_filename == "", "[No Name]", w.buf.current_filename)
+			lines = append(lines, fmt.Sprintf("%s %s %s", TernaryString(w == g.win, ">", " "),
+				TernaryString(w.buf.modified_count != 0, "+", " "), name))
+		})
+	}
+	g.show_lines(lines)
+}
+
+// the tab line: a label for each tab page, the current one not inverse
+func (g *globals) tab_line() []rune {
+	var cells []rune
+	for i, t := range g.tabs {
+		b := g.buffer // t.win is set when the page is left
+		if t != g.tab {
+			b = t.win.buf
+		}
+		name := TernaryString(b.current_filename == "", "[No Name]", filepath.Base(b.current_filename))
+		label := fmt.Sprintf(" %d %s%s ", i+1, TernaryString(b.modified_count != 0, "+ ", ""), name)
+		for _, c := range visible_text([]byte(label), g.columns) {
+			cells = append(cells, TernaryRune(t == g.tab, c, c|SCR_INVERSE))
+		}
+	}
+	for len(cells) < g.columns {
+		cells = append(cells, ' '|SCR_INVERSE)
+	}
+	return cells[:g.columns]
+}
@@ -0,0 +1,14 @@
+package main
+
+//----- Terminal -------------------------------------------------
+// The editor reads keys from and draws on a terminal: the tty it
+// runs on (tty_terminal in termios.go) or a screen in memory for
+// tests (virtual_terminal in vterm.go).
+type terminal interface {
+	size() (rows, cols int, ok bool)
+	read(buf []byte) (int, error) // input for keycode.go to decode, waits for a byte at least
+	write(b []byte)
+	raw_mode() int // returns the erase char
+	cooked_mode()
+	on_resize(fn func()) // fn is called, on any goroutine, when the size changes
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+	"os/signal"
 	"syscall"
 	"unsafe"
 )
@@ -81,3 +83,54 @@ func SetTermiosToRaw(fd int, oldterm *syscall.Termios, flags int) error {
 		uintptr(unsafe.Pointer(&newterm)), 0, 0, 0)
 	return err
 }
+
+//----- The tty backend of terminal ----------------------------
+type tty_terminal struct {
+	in, out *os.File
+	orig    syscall.Termios
+}
+
+func new_tty_terminal(in, out *os.File) *tty_terminal {
+	return &tty_terminal{in: in, out: out}
+}
+
+func (t *tty_terminal) size() (int, int, bool) {
+	var winsize = &struct {
+		Row    uint16
+		Col    uint16
+		Xpixel uint16
+		Ypixel uint16
+	}{}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+		t.in.Fd(),
+		uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(winsize)))
+	return int(winsize.Row), int(winsize.Col), errno == 0 && winsize.Row > 0
+}
+
+func (t *tty_terminal) read(buf []byte) (int, error) {
+	return t.in.Read(buf)
+}
+
+func (t *tty_terminal) write(b []byte) {
+	t.out.Write(b)
+}
+
+func (t *tty_terminal) raw_mode() int {
+	SetTermiosToRaw(int(t.in.Fd()), &t.orig, TERMIOS_RAW_CRNL)
+	return int(t.orig.Cc[syscall.VERASE])
+}
+
+func (t *tty_terminal) cooked_mode() {
+	SetTermios(t.in.Fd(), &t.orig)
+}
+
+func (t *tty_terminal) on_resize(fn func()) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGWINCH)
+	go func() {
+		for range sig {
+			fn()
+		}
+	}()
+}
@@ -0,0 +1,194 @@
+package main
+
+const (
+	UNDO_INS = 0 // text was inserted, undoing deletes it
+	UNDO_DEL = 1 // text was deleted, undoing puts it back
+)
+
+// One primitive change of the text
+type undo_object struct {
+	typ   int
+	start int
+	text  []byte
+}
+
+// One undo step: every change made by a single command.
+// An insert session counts as one command from 'i' to ESC.
+type undo_step struct {
+	objs []undo_object
+	dot  int // cursor before the command
+	seq  int
+}
+
+//----- Edit journal -------------------------------------------
+// Every change of the text goes through string_insert or
+// string_delete, which log it here. undo/redo replay the
+// logged objects in reverse or forward order.
+type undo_journal struct {
+	undo_stack []*undo_step
+	redo_stack []*undo_step
+	open       bool // changes are added to the top step
+	seq        int  // last step number handed out
+	saved_seq  int  // seq of the top step when the file was written
+
+	uline_valid bool
+	uline_start int    // begin of the line 'U' restores
+	uline_text  []byte // that line before it was changed
+}
+
+func (g *globals) undo_reset() {
+	g.undo = undo_journal{}
+}
+
+// the step number of the text as it is now, 0 = unchanged since load
+func (g *globals) undo_cur_seq() int {
+	if n := len(g.undo.undo_stack); n > 0 {
+		return g.undo.undo_stack[n-1].seq
+	}
+	return 0
+}
+
+// close the current step, the next change starts a new one
+func (g *globals) undo_close() {
+	g.undo.open = false
+}
+
+// remember that the text on disk matches the current state
+func (g *globals) undo_saved() {
+	g.undo.saved_seq = g.undo_cur_seq()
+	g.modified_count = 0
+}
+
+// log a change that is about to be made at start
+func (g *globals) undo_push(start int, text []byte, typ int) {
+	u := &g.undo
+	if !u.open {
+		u.seq++
+		u.undo_stack = append(u.undo_stack, &undo_step{dot: g.dot, seq: u.seq})
+		u.redo_stack = u.redo_stack[:0]
+		u.open = true
+	}
+	g.uline_remember(start)
+
+	step := u.undo_stack[len(u.undo_stack)-1]
+	if n := len(step.objs); n > 0 {
+		// merge with the previous object when the change continues it,
+		// so typing a line does not keep one object per key
+		last := &step.objs[n-1]
+		if last.typ == typ && typ == UNDO_INS && last.start+len(last.text) == start {
+			last.text = append(last.text, text...)
+			return
+		}
+		if last.typ == typ && typ == UNDO_DEL {
+			if last.start == start { // x x x
+				last.text = append(last.text, text...)
+				return
+			}
+			if start+len(text) == last.start { // backspace
+				last.text = append(append([]byte{}, text...), last.text...)
+				last.start = start
+				return
+			}
+		}
+	}
+	step.objs = append(step.objs, undo_object{typ: typ, start: start, text: text})
+}
+
+// remember the line about to change for 'U'
+func (g *globals) uline_remember(p int) {
+	b := g.begin_line(p)
+	if g.undo.uline_valid && g.undo.uline_start == b {
+		return
+	}
+	g.undo.uline_valid = true
+	g.undo.uline_start = b
+	g.undo.uline_text = g.text.copy_out(b, g.end_line(b))
+}
+
+// apply the objects of a step backwards (undo) or forwards (redo)
+func (g *globals) undo_apply(step *undo_step, undo bool) int {
+	dot := step.dot
+	for i := range step.objs {
+		o := step.objs[i]
+		if undo {
+			o = step.objs[len(step.objs)-1-i]
+		}
+		if (o.typ == UNDO_INS) == undo {
+			g.text_hole_delete(o.start, o.start+len(o.text))
+		} else {
+			copy(g.text_hole_make(o.start, len(o.text)), o.text)
+		}
+		dot = o.start
+	}
+	return dot
+}
+
+// the modified state follows the journal: back at the saved step is clean
+func (g *globals) undo_sync_modified() {
+	if g.undo_cur_seq() == g.undo.saved_seq {
+		g.modified_count = 0
+	} else if g.modified_count == 0 {
+		g.modified_count = 1
+	}
+}
+
+//----- u: undo the last step ----------------------------------
+func (g *globals) undo_pop() {
+	u := &g.undo
+	g.undo_close()
+	n := len(u.undo_stack)
+	if n == 0 {
+		g.status_line_bold("Already at oldest change")
+		return
+	}
+	step := u.undo_stack[n-1]
+	u.undo_stack = u.undo_stack[:n-1]
+	u.redo_stack = append(u.redo_stack, step)
+	g.undo_move_dot(g.undo_apply(step, true))
+	u.uline_valid = false
+	g.undo_sync_modified()
+}
+
+//----- ctrl-R: redo the last undone step ----------------------
+func (g *globals) redo_pop() {
+	u := &g.undo
+	g.undo_close()
+	n := len(u.redo_stack)
+	if n == 0 {
+		g.status_line_bold("Already at newest change")
+		return
+	}
+	step := u.redo_stack[n-1]
+	u.redo_stack = u.redo_stack[:n-1]
+	u.undo_stack = append(u.undo_stack, step)
+	g.undo_move_dot(g.undo_apply(step, false))
+	u.uline_valid = false
+	g.undo_sync_modified()
+}
+
+func (g *globals) undo_move_dot(p int) {
+	if p >= g.text.size() {
+		p = g.text.size() - 1
+	}
+	g.dot = TernaryInt(p < 0, 0, p)
+}
+
+//----- U: undo all changes on the last changed line -----------
+// The restore is a change of its own, so 'u' undoes it and
+// a second 'U' puts the changes back.
+func (g *globals) undo_line() {
+	u := &g.undo
+	if !u.uline_valid || u.uline_start > g.text.size() {
+		return
+	}
+	b := u.uline_start
+	e := g.end_line(b)
+	old := g.text.copy_out(b, e)
+	restore := u.uline_text
+	g.undo_close()
+	g.string_delete(b, e)
+	g.string_insert(b, restore)
+	g.undo_close()
+	u.uline_valid, u.uline_start, u.uline_text = true, b, old
+	g.dot = b
+}
@@ -3,15 +3,14 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/signal"
 	"strconv"
 	"strings"
-	"syscall"
 	"unicode"
-	"unsafe"
+	"unicode/utf8"
 )
 
 const (
@@ -24,6 +23,17 @@ const (
 	MAX_SCR_ROWS = 4096
 )
 
+// Screen cell taken by the right half of a wide character. Above
+// the runes, so it is no char and no cell new_screen left empty.
+const SCR_WIDE_PAD = 1 << 29
+
+// Set in a screen cell holding a char with combining marks: the rest
+// of the cell is its index in g.clusters
+const SCR_CLUSTER = 1 << 28
+
+// Set in a screen cell shown in inverse video, the visual selection
+const SCR_INVERSE = 1 << 30
+
 const ESC = "\033"
 
 /* Inverse/Normal text */
@@ -44,43 +54,102 @@ const ESC_CLEAR2EOS = ESC + "[J"
 const ESC_SET_CURSOR_POS = ESC + "[%d;%dH"
 
 type globals struct {
-	screen        []byte
-	text          []byte
+	*buffer                // the buffer being edited: g.text, g.dot and so on
+	out        term_output // what is sent to the terminal, see output.go
+	win        *window     // the current window, see windows.go
+	frame_root *frame
+	win_seps   [][3]int  // row, column and height of a '|' between windows
+	tab        *tab_page // the current tab page, see tabs.go
+	tabs       []*tab_page
+
+	screen        []rune          // virtual screen, a rune per cell
+	clusters      []string        // chars with combining marks, see SCR_CLUSTER
+	cluster_ids   map[string]rune // their cells
 	editing       int
 	rows, columns int // the terminal screen is this size
 	crow, ccol    int // cursor is on Crow x Ccol
 
-	screenbegin       int
-	end               int
 	tabstop           int
-	dot               int
 	cmd_mode          int
 	cmdcnt            int
 	line_number_width int
-	modified_count    int
 	erase_char        int
 	last_input_char   byte
 
-	term_orig syscall.Termios
+	term terminal
 
-	scr_out_buf         [MAX_SCR_COLS + MAX_TABSTOP*2]byte
+	scr_out_buf         [MAX_SCR_COLS + MAX_TABSTOP*2]rune
 	readbuffer          [KEYCODE_BUFFER_SIZE]byte
-	get_input_line__buf [MAX_INPUT_LEN]byte
-	current_filename    string
+	input               []byte     // read from the terminal, not yet in readbuffer
+	read_starts         uint32     // bit i: readbuffer byte i began a read
+	read_ends           uint32     // bit i: it ended one, see keycode.go
+	read_err            error      // reading the terminal failed, edit_file returns it
+	events              chan event // see events.go
+	screen_dirty        bool       // the terminal changed size, draw all of it again
+	repaint             func()     // draws a prompt again after that
+	get_input_line__buf [MAX_INPUT_LEN]rune
 	status_buffer       bytes.Buffer
 	last_search_pattern string
+	last_search_offset  string // e+1 in /foo/e+1
+	last_search_dir     int    // 1 after /, -1 after ?
+	last_sub_pattern    string // for :& and & to repeat :s
+	last_sub_rep        string
+	last_sub_flags      string
+	global_lines        *line_marks   // lines :g still has to do
+	marked              []*line_marks // kept in place by the edits, see ex.go
+
+	ioq     []int // keys queued by :normal, read before the terminal
+	ioq_esc bool  // running :normal, ESC once ioq is empty
+
+	visual_mode  int // 0, 'v', 'V' or VISUAL_BLOCK
+	visual_start int // the end of the selection that is not dot
+	visual_eol   bool
+	vsel         visual_sel
+	block_ins    block_insert
+
+	insert_start  int      // where insert mode started, for ctrl-W ctrl-U
+	replace_start int      // where R started
+	replace_saved [][]byte // what each char typed in R replaced, nil if added
+	replace_cnt   int
+
+	shiftwidth  int
+	op_pending  bool // an operator waits for its motion
+	regs        [REG_COUNT]register
+	reg_unnamed int // index of the register "" refers to
+	cur_reg     int // register selected with "x for the next command
+
+	last_find_cmd  int // f F t T, for ; and ,
+	last_find_char int
+
+	args        []string // the argument list
+	arg_idx     int
+	buffers     []*buffer // :ls
+	buffer_num  int       // the number of the last buffer made
+	alt_buf     *buffer   // the buffer edited before, for :e # and ctrl-^
+	autowrite   bool
+	hidden      bool // buffers keep changes when not shown
+	quit_warned bool // :q said there are more files
+
+	changes          int   // text changes made, for . to tell commands that change
+	cmd_keys         []int // keys of the command being run
+	cmd_changes      int   // changes when it started
+	change_cnt       int   // its count
+	change_mcnt      int   // the count of its motion, d3w
+	last_change      []int // keys of the last command that changed the text
+	last_change_cnt  int
+	last_change_mcnt int
+	dot_replay       bool // running .
+
+	recording     int   // register q is recording into, or 0
+	rec_keys      []int // keys typed since
+	last_macro    int   // for @@
+	macro_running bool
+	key_failed    bool // a motion failed, a macro stops
 }
 
-func (g *globals) init() {
-	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGWINCH)
-	go func() {
-		for range c {
-			g.query_screen_dimensions()
-			g.new_screen(g.rows, g.columns)
-			g.redraw(true)
-		}
-	}()
+func (g *globals) init(t terminal) {
+	g.term = t
+	g.events_start()
 }
 
 //----- Terminal Drawing ---------------------------------------
@@ -100,12 +169,12 @@ func (g *globals) place_cursor(row, col int) {
 	row = TernaryInt(row >= g.rows, g.rows-1, row)
 	col = TernaryInt(col < 0, 0, col)
 	col = TernaryInt(col >= g.columns, g.columns-1, col)
-	fmt.Printf(ESC_SET_CURSOR_POS, row+1, col+1)
+	g.out_printf(ESC_SET_CURSOR_POS, row+1, col+1)
 }
 
 //----- Erase from cursor to end of line -----------------------
 func (g *globals) clear_to_eol() {
-	fmt.Printf(ESC_CLEAR2EOL)
+	g.out_printf(ESC_CLEAR2EOL)
 }
 
 func (g *globals) go_bottom_and_clear_to_eol() {
@@ -115,7 +184,7 @@ func (g *globals) go_bottom_and_clear_to_eol() {
 
 //----- Erase from cursor to end of screen -----------------------
 func (g *globals) clear_to_eos() {
-	fmt.Printf(ESC_CLEAR2EOS)
+	g.out_printf(ESC_CLEAR2EOS)
 }
 
 //----- Force refresh of all Lines -----------------------------
@@ -126,29 +195,59 @@ func (g *globals) redraw(full_screen bool) {
 	g.refresh(full_screen)
 }
 
+//----- Show lines of output, for :registers and the like -------
+// They scroll up from the status line, a page at a time.
+// A key press brings the text back.
+func (g *globals) show_lines(lines []string) {
+	old := g.repaint
+	for len(lines) > 0 {
+		page := g.rows - 1
+		n := TernaryInt(len(lines) > page, page, len(lines))
+		shown := lines[:n]
+		lines = lines[n:]
+		g.repaint = func() {
+			for i, l := range shown {
+				g.place_cursor(g.rows-1-len(shown)+i, 0)
+				g.clear_to_eol()
+				g.out_printf("%s", visible_text([]byte(l), g.columns))
+			}
+			g.go_bottom_and_clear_to_eol()
+			if len(lines) > 0 {
+				g.out_printf("-- More --")
+			} else {
+				g.out_printf("Press ENTER or type command to continue")
+			}
+		}
+		g.repaint()
+		if c := g.get_one_char(); c == 'q' || c == 27 {
+			break
+		}
+	}
+	g.repaint = old
+	g.redraw(true)
+}
+
 //----- Draw the status line at bottom of the screen -------------
 func (g *globals) show_status_line() {
-	if g.status_buffer.Len() == 0 {
+	if g.status_buffer.Len() == 0 && g.recording != 0 && g.visual_mode == 0 {
+		g.status_line("recording @%c", g.recording)
 	}
 	if g.status_buffer.Len() > 0 {
 		g.go_bottom_and_clear_to_eol()
-		fmt.Printf("%s", g.status_buffer.Bytes())
+		g.out_printf("%s", g.status_buffer.Bytes())
 		g.status_buffer.Reset()
-		g.place_cursor(g.crow, g.ccol)
+		g.place_cursor_at_dot()
 	}
 }
 
+// start of line li, from 1
 func (g *globals) find_line(li int) int {
-	var dot = 0
-	for ; li > 1; li-- {
-		dot = g.next_line(dot)
-	}
-	return dot
+	return g.text.line_start(li - 1)
 }
 
 func (g *globals) format_line_number(src int) []byte {
-	cnt := g.count_lines(g.text[:src])
-	lastcnt := g.count_lines(g.text[src:])
+	cnt := g.text.line_of(src)
+	lastcnt := g.text.newlines() - cnt
 	if lastcnt == 0 {
 		g.line_number_width = 0
 		return nil
@@ -160,18 +259,56 @@ func (g *globals) format_line_number(src int) []byte {
 	return bts
 }
 
-func (g *globals) format_line(src int) []byte {
-	dest := g.scr_out_buf
+// the cell for text, a char and its combining marks
+func (g *globals) cluster(text string) rune {
+	id, ok := g.cluster_ids[text]
+	if !ok {
+		if g.cluster_ids == nil {
+			g.cluster_ids = map[string]rune{}
+		}
+		id = SCR_CLUSTER | rune(len(g.clusters))
+		g.clusters = append(g.clusters, text)
+		g.cluster_ids[text] = id
+	}
+	return id
+}
+
+// the text shown in cell c, without SCR_INVERSE
+func (g *globals) cell_string(c rune) string {
+	switch {
+	case c == SCR_WIDE_PAD:
+		return ""
+	case c&SCR_CLUSTER != 0:
+		return g.clusters[c&^SCR_CLUSTER]
+	}
+	return string(c)
+}
+
+// format_line returns one row of the current window, a rune per cell. A wide
+// character fills its cell and a SCR_WIDE_PAD cell after it, combining
+// marks share the cell of the char before them. sel: show the visual
+// selection, only the window it was made in does.
+func (g *globals) format_line(src int, sel bool) []rune {
+	dest := g.scr_out_buf[:]
+	width := g.win.width
 	bts := g.format_line_number(src)
-	copy(dest[:], bts)
+	for i, b := range bts {
+		dest[i] = rune(b)
+	}
 
-	var c byte = '~'
+	var c rune = '~'
 	var co int = g.line_number_width
-	for co < g.columns+g.tabstop {
-		if src < g.end {
-			c = g.text[src]
-			src++
+	eol := -1 // cell of a selected '\n'
+	for co < width+g.tabstop {
+		p, co0 := src, co
+		if src < g.text.size() {
+			var size int
+			c, size = g.text.rune_at(src)
+			src += size
 			if c == '\n' {
+				if sel && g.visual_has(p, co-g.line_number_width, co+1-g.line_number_width) {
+					eol = co
+				}
 				break
 			}
 			if c < ' ' || c == 0x7f {
@@ -181,27 +318,58 @@ func (g *globals) format_line(src int) []byte {
 						dest[co] = c
 						co++
 					}
+				} else {
+					// display as ^X
+					dest[co] = '^'
+					co++
+					c = TernaryRune(c == 0x7f, '?', c+'@')
+				}
+			} else if w := RuneWidth(c); w == 0 {
+				// a combining mark goes with the char before it
+				if q := co - TernaryInt(co > 0 && dest[co-1]&^SCR_INVERSE == SCR_WIDE_PAD, 2, 1); q >= g.line_number_width {
+					dest[q] = dest[q]&SCR_INVERSE | g.cluster(g.cell_string(dest[q]&^SCR_INVERSE)+string(c))
+					if src >= g.text.size() {
+						break
+					}
+					continue
+				}
+				c = g.cluster(" " + string(c))
+			} else if w == 2 {
+				if co+1 >= width {
+					c = ' ' // does not fit on this row
+				} else {
+					dest[co] = c
+					co++
+					c = SCR_WIDE_PAD
 				}
 			}
 		}
 		dest[co] = c
 		co++
-		if src >= g.end {
+		if sel && g.visual_has(p, co0-g.line_number_width, co-g.line_number_width) {
+			for i := co0; i < co; i++ {
+				dest[i] |= SCR_INVERSE
+			}
+		}
+		if src >= g.text.size() {
 			break
 		}
 	}
 	// log.Printf("format line start %v, %s, co %v", src, dest[:co], co)
-	if co < g.columns {
-		for i := co; i < g.columns; i++ {
+	if co < width {
+		for i := co; i < width; i++ {
 			dest[i] = ' '
 		}
 	}
-	return dest[:]
+	if eol >= 0 && eol < width {
+		dest[eol] |= SCR_INVERSE
+	}
+	return dest
 }
 
 func (g *globals) begin_line(d int) int { // return index to first char for cur line
-	if d > 0 && d < len(g.text) {
-		n := strings.LastIndexByte(BytesToStr(g.text[:d]), '\n')
+	if d > 0 && d <= g.text.size() {
+		n := g.text.last_index_byte(0, d, '\n')
 		if n < 0 {
 			return 0
 		}
@@ -211,19 +379,19 @@ func (g *globals) begin_line(d int) int { // return index to first char for cur
 }
 
 func (g *globals) end_line(p int) int {
-	if p >= 0 && p < g.end {
-		n := strings.IndexByte(BytesToStr(g.text[p:g.end]), '\n')
+	if p >= 0 && p < g.text.size() {
+		n := g.text.index_byte(p, g.text.size(), '\n')
 		if n < 0 {
-			return g.end
+			return g.text.size()
 		}
-		return p + n
+		return n
 	}
 	return p
 }
 
 func (g *globals) prev_line(p int) int {
 	p = g.begin_line(p)
-	if p > 0 && p <= g.end && g.text[p-1] == '\n' {
+	if p > 0 && p <= g.text.size() && g.text.at(p-1) == '\n' {
 		p--
 	}
 	p = g.begin_line(p)
@@ -232,7 +400,7 @@ func (g *globals) prev_line(p int) int {
 
 func (g *globals) next_line(p int) int {
 	p = g.end_line(p)
-	if p < g.end && g.text[p] == '\n' {
+	if p < g.text.size() && g.text.at(p) == '\n' {
 		p++
 	}
 	return p
@@ -240,7 +408,7 @@ func (g *globals) next_line(p int) int {
 
 func (g *globals) end_screen() int {
 	q := g.screenbegin
-	for cnt := 0; cnt < g.rows-2; cnt++ {
+	for cnt := 0; cnt < g.win.height-1; cnt++ {
 		q = g.next_line(q)
 	}
 	q = g.end_line(q)
@@ -254,20 +422,17 @@ func (g *globals) sync_cursor(d int, row, col *int) {
 	//log.Printf("sync cursor beg_cur %d, screenbegin %d",
 	// 	beg_cur, g.screenbegin)
 	if beg_cur < g.screenbegin {
-		// cnt := g.count_lines(g.text[beg_cur:g.screenbegin])
 		g.screenbegin = beg_cur
 	} else {
 		end_scr := g.end_screen()
 		if beg_cur > end_scr {
-			cnt := g.count_lines(g.text[end_scr:beg_cur])
+			cnt := g.count_lines(end_scr, beg_cur)
 			log.Printf("sync cursor update screenbegin %v,%v", d, g.screenbegin)
-			for ro = 0; ro < cnt; ro++ {
-				g.screenbegin = g.next_line(g.screenbegin)
-			}
+			g.screenbegin = g.text.line_start(g.text.line_of(g.screenbegin) + cnt)
 		}
 	}
 	tp := g.screenbegin
-	for ro = 0; ro < g.rows-1; ro++ {
+	for ro = 0; ro < g.win.height; ro++ {
 		// log.Printf("sync cursor tp %d, beg_cur %d", tp, beg_cur)
 		if tp == beg_cur {
 			break
@@ -277,19 +442,19 @@ func (g *globals) sync_cursor(d int, row, col *int) {
 
 	// find out what col "d" is on
 	for tp < d {
-		if g.text[tp] == '\n' {
+		c, size := g.text.rune_at(tp)
+		if c == '\n' {
 			break
-		} else if g.text[tp] == '\t' {
+		} else if c == '\t' {
 			co = g.next_tabstop(co)
-		} else if g.text[tp] < ' ' || g.text[tp] == 0x7f {
+		} else if c < ' ' || c == 0x7f {
 			co++ // display as ^X, use 2 columns
 		}
-		log.Printf("tp %d,co %d,d %d", tp, co, d)
-		co++
-		tp++
+		co += RuneWidth(c)
+		tp += size
 	}
 
-	if g.text[d] == '\t' {
+	if g.text.at(d) == '\t' {
 		co = co + (g.tabstop - 1)
 	}
 	*row = ro
@@ -301,58 +466,76 @@ func (g *globals) next_tabstop(col int) int {
 	return col + ((g.tabstop - 1) - (col % g.tabstop))
 }
 
+// refresh draws what changed on the screen: the windows, the
+// current one last, and the lines between them
 func (g *globals) refresh(full_screen bool) {
-	g.sync_cursor(g.dot, &g.crow, &g.ccol)
-	tp := g.screenbegin
-	for li := 0; li < g.rows-1; li++ {
-		out_buf := g.format_line(tp)
-		if tp < g.end {
-			n := strings.IndexByte(BytesToStr(g.text[tp:g.end]), '\n')
-			if n < 0 {
-				n = g.end - 1
-			}
-			tp += n + 1
+	g.win_layout()
+	cur := g.win
+	for _, w := range g.windows() {
+		if w != cur {
+			g.win_enter(w)
+			g.win_refresh(full_screen, false)
 		}
-		// log.Printf("refresh tp %d", tp)
+	}
+	g.win_enter(cur)
+	g.win_refresh(full_screen, g.visual_mode != 0)
+	g.win_draw_seps(full_screen)
+	if len(g.tabs) > 1 {
+		g.screen_put(0, 0, g.tab_line(), full_screen)
+	}
+	g.place_cursor_at_dot()
+}
 
-		changed := false
-		var cs = 0
-		ce := g.columns - 1
-		sp := g.screen[li*g.columns:]
-		if full_screen {
-			changed = true
-		} else {
-			// compare newly formatted buffer with virtual screen
-			// look backward for last difference between out_buf and screen
-			for ; cs <= ce; cs++ {
-				if out_buf[cs] != sp[cs] {
-					changed = true
-					break
-				}
+// put the terminal cursor on dot in the current window
+func (g *globals) place_cursor_at_dot() {
+	col := g.ccol + g.line_number_width
+	g.place_cursor(g.win.top+g.crow, g.win.left+TernaryInt(col >= g.win.width, g.win.width-1, col))
+}
+
+// screen_put writes cells to the screen at row, col, sending only
+// the part that differs from what the virtual screen already shows
+func (g *globals) screen_put(row, col int, cells []rune, full_screen bool) {
+	changed := false
+	var cs = 0
+	ce := len(cells) - 1
+	sp := g.screen[row*g.columns+col:]
+	if full_screen {
+		changed = true
+	} else {
+		// look forward for first difference between cells and screen
+		for ; cs <= ce; cs++ {
+			if cells[cs] != sp[cs] {
+				changed = true
+				break
 			}
+		}
 
-			// look backward for last difference between out_buf and screen
-			for ; ce >= cs; ce-- {
-				if out_buf[ce] != sp[ce] {
-					changed = true
-					break
-				}
+		// look backward for last difference between cells and screen
+		for ; ce >= cs; ce-- {
+			if cells[ce] != sp[ce] {
+				changed = true
+				break
 			}
 		}
+	}
 
-		cs = TernaryInt(cs < 0, 0, cs)
-		ce = TernaryInt(ce > g.columns-1, g.columns-1, ce)
-		if cs > ce {
-			cs, ce = 0, g.columns-1
+	cs = TernaryInt(cs < 0, 0, cs)
+	ce = TernaryInt(ce > len(cells)-1, len(cells)-1, ce)
+	if cs > ce {
+		cs, ce = 0, len(cells)-1
+	}
+	if changed {
+		// never start or end the update in the middle of a wide char
+		if cs > 0 && cells[cs]&^SCR_INVERSE == SCR_WIDE_PAD {
+			cs--
 		}
-		if changed {
-			// log.Printf("li:%d,%2d,%2d,cnt:%s-%s\n", li, cs, ce, sp[:ce+1], out_buf[:ce+1])
-			copy(sp[cs:], out_buf[cs:ce+1])
-			g.place_cursor(li, cs)
-			fmt.Printf("%s", sp[cs:ce+1])
+		if ce < len(cells)-1 && cells[ce+1]&^SCR_INVERSE == SCR_WIDE_PAD {
+			ce++
 		}
+		copy(sp[cs:], cells[cs:ce+1])
+		g.place_cursor(row, col+cs)
+		g.out_printf("%s", g.screen_string(sp[cs:ce+1]))
 	}
-	g.place_cursor(g.crow, g.ccol+g.line_number_width)
 }
 
 func (g *globals) screen_erase() {
@@ -362,42 +545,42 @@ func (g *globals) screen_erase() {
 }
 
 func (g *globals) new_screen(row, col int) {
-	g.screen = make([]byte, row*col+8)
+	g.screen = make([]rune, row*col+8)
 	for li := 1; li < row-1; li++ {
 		g.screen[li*col] = '~'
 	}
 }
 
+// the text of a run of screen cells, without the wide char pads
+func (g *globals) screen_string(cells []rune) string {
+	var b strings.Builder
+	inv := false
+	for _, c := range cells {
+		if (c&SCR_INVERSE != 0) != inv {
+			inv = !inv
+			b.WriteString(TernaryString(inv, ESC_BOLD_TEXT, ESC_NORM_TEXT))
+		}
+		b.WriteString(g.cell_string(c &^ SCR_INVERSE))
+	}
+	if inv {
+		b.WriteString(ESC_NORM_TEXT)
+	}
+	return b.String()
+}
+
 func (g *globals) dot_next() {
-	g.dot = g.next_line(g.dot)
+	if q := g.next_line(g.dot); q < g.text.size() {
+		g.dot = q
+	}
 }
 
 func (g *globals) dot_begin() {
 	g.dot = g.begin_line(g.dot)
 }
 
-func (g *globals) char_search(p int, pat string, dir_and_range int) int {
-	if p < 0 || p >= g.end {
-		return -1
-	}
-	if dir_and_range > 0 {
-		// log.Printf("char search:%v,pat:%v,text:%s", p, pat, g.text[p:g.end])
-		n := strings.Index(BytesToStr(g.text[p:g.end]), pat)
-		if n >= 0 {
-			return g.dot + n
-		}
-	} else {
-		n := strings.LastIndex(BytesToStr(g.text[0:p]), pat)
-		if n >= 0 {
-			return n
-		}
-	}
-	return -1
-}
-
 func (g *globals) dot_left() {
-	if g.dot > 0 && g.text[g.dot-1] != '\n' {
-		g.dot--
+	if g.dot > 0 && g.text.at(g.dot-1) != '\n' {
+		g.dot = g.prev_rune(g.dot)
 	}
 }
 
@@ -412,26 +595,262 @@ func (g *globals) dot_end() {
 func (g *globals) move_to_col(p int, l int) int {
 	var co int = 0
 	p = g.begin_line(p)
-	for co < l && p < g.end {
-		if g.text[p] == '\n' {
+	for co < l && p < g.text.size() {
+		c, size := g.text.rune_at(p)
+		if c == '\n' {
 			break
 		}
-		if g.text[p] == '\t' {
-			co = g.next_tabstop(co)
-		} else if g.text[p] < ' ' || g.text[p] == 127 {
-			co++ // display as ^X, use 2 columns
+		co = g.col_after(c, co)
+		if co > l {
+			break // l is inside this char
 		}
-		co++
-		p++
+		p += size
 	}
 	log.Printf("move to col %d,p %d", co, p)
 	return p
 }
 
+// screen column of the char at p, from 0
+func (g *globals) col_of(p int) int {
+	co := 0
+	for q := g.begin_line(p); q < p; {
+		c, size := g.text.rune_at(q)
+		co = g.col_after(c, co)
+		q += size
+	}
+	return co
+}
+
+// the column after char c shown at column co
+func (g *globals) col_after(c rune, co int) int {
+	if c == '\t' {
+		return g.next_tabstop(co) + 1
+	}
+	if c < ' ' || c == 0x7f {
+		return co + 2 // display as ^X
+	}
+	return co + RuneWidth(c)
+}
+
 func (g *globals) dot_right() {
-	if g.dot < g.end-1 && g.text[g.dot+1] != '\n' {
-		g.dot++
+	q := g.next_rune(g.dot)
+	if q < g.text.size() && g.text.at(q) != '\n' {
+		g.dot = q
+	}
+}
+
+// start of the char after the one at p
+func (g *globals) next_rune(p int) int {
+	_, size := g.text.rune_at(p)
+	return p + size
+}
+
+// start of the char before p
+func (g *globals) prev_rune(p int) int {
+	q := p - 1
+	for q > 0 && q > p-utf8.UTFMax && !utf8.RuneStart(g.text.at(q)) {
+		q--
+	}
+	if _, size := g.text.rune_at(q); q+size != p {
+		return p - 1 // p is inside invalid UTF-8, step one byte
+	}
+	return q
+}
+
+//----- Word, sentence and paragraph motions -------------------
+// They take a position and return the new one, so both dot and
+// operators can use them. A result may be g.text.size() when the
+// motion ran off the end of the text.
+
+// char classes for word motions: 0 blank, 1 punctuation, 2 word chars.
+// For W B E ge "big" words everything non-blank is one class.
+func (g *globals) char_class(p int, big bool) int {
+	c, _ := g.text.rune_at(p)
+	if c == ' ' || c == '\t' || c == '\n' || p >= g.text.size() {
+		return 0
+	}
+	if big || c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c) {
+		return 2
+	}
+	return 1
+}
+
+// an empty line starts at p
+func (g *globals) is_empty_line(p int) bool {
+	return g.text.at(p) == '\n' && (p == 0 || g.text.at(p-1) == '\n')
+}
+
+// w W: start of the next word. An empty line counts as a word.
+func (g *globals) next_word(p int, big bool) int {
+	size := g.text.size()
+	if cls := g.char_class(p, big); cls != 0 {
+		for p < size && g.char_class(p, big) == cls {
+			p = g.next_rune(p)
+		}
+	}
+	for p < size && g.char_class(p, big) == 0 {
+		p = g.next_rune(p)
+		if g.is_empty_line(p) {
+			break
+		}
+	}
+	return p
+}
+
+// e E: end of the word, the next one if p already is at the end
+func (g *globals) end_word(p int, big bool) int {
+	size := g.text.size()
+	p = g.next_rune(p)
+	for p < size && g.char_class(p, big) == 0 {
+		p = g.next_rune(p)
+	}
+	cls := g.char_class(p, big)
+	for q := g.next_rune(p); q < size && g.char_class(q, big) == cls; q = g.next_rune(q) {
+		p = q
+	}
+	return p
+}
+
+// b B: start of the word, the previous one if p already is at the start
+func (g *globals) prev_word(p int, big bool) int {
+	if p <= 0 {
+		return 0
+	}
+	p = g.prev_rune(p)
+	for p > 0 && g.char_class(p, big) == 0 && !g.is_empty_line(p) {
+		p = g.prev_rune(p)
+	}
+	cls := g.char_class(p, big)
+	for p > 0 && cls != 0 && g.char_class(g.prev_rune(p), big) == cls {
+		p = g.prev_rune(p)
+	}
+	return p
+}
+
+// ge gE: end of the previous word
+func (g *globals) prev_word_end(p int, big bool) int {
+	if cls := g.char_class(p, big); cls != 0 {
+		for p > 0 && g.char_class(p, big) == cls {
+			p = g.prev_rune(p)
+		}
+	}
+	for p > 0 && g.char_class(p, big) == 0 && !g.is_empty_line(p) {
+		p = g.prev_rune(p)
+	}
+	return p
+}
+
+// A sentence starts after '.', '!' or '?', optionally followed by
+// closing ) ] " ', and then white space. Empty lines are sentence
+// (and paragraph) boundaries.
+func (g *globals) is_sentence_start(q int) bool {
+	c := g.text.at(q)
+	if q == 0 || g.is_empty_line(q) {
+		return true
+	}
+	if c == ' ' || c == '\t' || c == '\n' {
+		return false
+	}
+	if g.is_empty_line(q - 1) {
+		return true
+	}
+	r := q - 1
+	if c = g.text.at(r); c != ' ' && c != '\t' && c != '\n' {
+		return false
+	}
+	for ; r >= 0; r-- {
+		c = g.text.at(r)
+		if c != ' ' && c != '\t' && c != '\n' {
+			break
+		}
+		if g.is_empty_line(r) {
+			return true
+		}
+	}
+	for r >= 0 && strings.IndexByte(")]\"'", g.text.at(r)) >= 0 {
+		r--
+	}
+	return r < 0 || strings.IndexByte(".!?", g.text.at(r)) >= 0
+}
+
+// ) start of the next sentence
+func (g *globals) next_sentence(p int) int {
+	for p < g.text.size() {
+		p = g.next_rune(p)
+		if g.is_sentence_start(p) {
+			break
+		}
+	}
+	return p
+}
+
+// ( start of the sentence, the previous one if p already is there
+func (g *globals) prev_sentence(p int) int {
+	for p > 0 {
+		p = g.prev_rune(p)
+		if g.is_sentence_start(p) {
+			break
+		}
+	}
+	return p
+}
+
+// } the empty line after the paragraph
+func (g *globals) next_paragraph(p int) int {
+	p = g.begin_line(p)
+	for p < g.text.size() && g.is_empty_line(p) {
+		p = g.next_line(p)
+	}
+	for p < g.text.size() && !g.is_empty_line(p) {
+		p = g.next_line(p)
+	}
+	return p
+}
+
+// { the empty line before the paragraph
+func (g *globals) prev_paragraph(p int) int {
+	p = g.begin_line(p)
+	for p > 0 && g.is_empty_line(p) {
+		p = g.prev_line(p)
+	}
+	for p > 0 && !g.is_empty_line(p) {
+		p = g.prev_line(p)
+	}
+	return p
+}
+
+// f F t T: the cnt'th c in the line forwards (f t) or backwards (F T).
+// t and T stop next to it. Returns -1 if there are not that many.
+// When repeated with ; or , t and T skip the char right next to p,
+// or they would find the same c again.
+func (g *globals) find_char(p int, c int, cmd int, cnt int, again bool) int {
+	fwd := cmd == 'f' || cmd == 't'
+	till := cmd == 't' || cmd == 'T'
+	b, e := g.begin_line(p), g.end_line(p)
+	step := func(q int) int {
+		if fwd {
+			return g.next_rune(q)
+		}
+		return TernaryInt(q <= b, -1, g.prev_rune(q))
+	}
+	q := p
+	if till && again {
+		q = step(q)
+	}
+	for ; cnt > 0; cnt-- {
+		for {
+			if q = step(q); q < b || q >= e {
+				return -1
+			}
+			if r, _ := g.text.rune_at(q); int(r) == c {
+				break
+			}
+		}
 	}
+	if till {
+		q = TernaryInt(fwd, g.prev_rune(q), g.next_rune(q))
+	}
+	return q
 }
 
 func (g *globals) dot_scroll(cnt, dir int) {
@@ -459,6 +878,10 @@ func (g *globals) dot_scroll(cnt, dir int) {
 
 func (g *globals) do_cmd(c int) {
 	log.Printf("do cmd %d", c)
+	mode := g.cmd_mode
+	if mode == 0 {
+		g.change_begin(c)
+	}
 	switch c {
 	case
 		KEYCODE_UP,
@@ -470,9 +893,12 @@ func (g *globals) do_cmd(c int) {
 		KEYCODE_PAGEUP,
 		KEYCODE_PAGEDOWN,
 		KEYCODE_DELETE:
+		mode = 0 // moving in insert mode starts a new insert there
 		goto key_cmd_mode
 	}
 	if g.cmd_mode == 2 {
+		g.dot = g.char_replace(g.dot, c)
+		goto dc1
 	}
 	if g.cmd_mode == 1 {
 		if 1 <= c || strconv.IsPrint(rune(c)) {
@@ -481,41 +907,36 @@ func (g *globals) do_cmd(c int) {
 		goto dc1
 	}
 key_cmd_mode:
+	if c == 'g' {
+		c = KEY_G - g.get_one_char()
+	}
+	if g.visual_mode != 0 && g.do_visual(c) {
+		goto dc1
+	}
 	switch c {
-	case 2: // ctrl-b  scroll up full screen
-		g.dot_scroll(g.rows-2, -1)
+	default:
+		save := g.dot
+		if kind := g.do_motion(c); kind == MOTION_FAILED {
+			g.key_failed = true
+		} else if kind != MOTION_NONE && is_jump(c) {
+			g.jump_push(save)
+		}
+	case 2, KEYCODE_PAGEUP: // ctrl-b  scroll up full screen
+		g.dot_scroll(g.win.height-1, -1)
 	case 4: // ctrl-D  scroll down half screen
-		g.dot_scroll((g.rows-2)/2, 1)
+		g.dot_scroll((g.win.height-1)/2, 1)
 	case 5: // ctrl-E  scroll down one line
 		g.dot_scroll(1, 1)
-	case 6: // ctrl-f  scroll down full screen
-		g.dot_scroll(g.rows-2, 1)
-	case '/', '?':
-		s := g.get_input_line(string(c))
-		if len(s) == 1 { // if no pat re-use old pat
-
-		} else {
-			g.last_search_pattern = s
-			p := g.char_search(g.dot+1, s[1:], TernaryInt(c == '/', 1, -1))
-			if p >= 0 {
-				g.dot = p + 1
-			}
-		}
-	case 'n', 'N':
-		s := g.last_search_pattern
-		log.Printf("%s %s,", string(byte(c)), s)
-		if len(s) > 0 {
-			p := g.char_search(g.dot+1, s[1:], TernaryInt(c == 'n', 1, -1))
-			log.Printf("%s %s,cur %d p %d,end %d", string(byte(c)), s, g.dot, p, g.end)
-			if p >= 0 {
-				g.dot = p + 1
-			}
-		}
+	case 6, KEYCODE_PAGEDOWN: // ctrl-f  scroll down full screen
+		g.dot_scroll(g.win.height-1, 1)
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 		if c == '0' && g.cmdcnt < 1 {
-			g.dot_begin()
+			g.do_motion(c)
 		} else {
 			g.cmdcnt = g.cmdcnt*10 + (c - '0')
+			if g.visual_mode == 0 && len(g.cmd_keys) > 0 {
+				g.cmd_keys = g.cmd_keys[:len(g.cmd_keys)-1] // . keeps the count apart
+			}
 		}
 	case 27: // esc
 		g.cmd_mode = 0
@@ -523,47 +944,50 @@ key_cmd_mode:
 		p := g.get_input_line(":") // get input line- use "status line"
 		g.colon(p)                 // execute the command
 	case 'a':
-		if g.text[g.dot] != '\n' {
-			g.dot++
+		if g.text.at(g.dot) != '\n' {
+			g.dot = g.next_rune(g.dot)
 			g.cmd_mode = 1
 		}
 	case 'A':
 		g.dot_end()
 		g.cmd_mode = 1 // start inserting
-	case '$':
-		g.dot_end()
+	case 'R': // R- replace mode, typing over the text
+		g.cmd_mode = 2
+		g.replace_start = g.dot
+		g.replace_saved = g.replace_saved[:0]
+		g.replace_cnt = g.cmdcnt
 	case 'i', KEYCODE_INSERT: // i- insert before current char // Cursor Key Insert
 		// dc_i:
 		g.cmd_mode = 1 // start inserting
-	case 'g', 'G':
-		if c == 'g' {
-			c1 := g.get_one_char()
-			if c1 != 'g' {
-				break
-			}
-			if g.cmdcnt == 0 {
-				g.cmdcnt = 1
-			}
+	case 'd', 'c', 'y', '<', '>': // operators, take a motion
+		g.do_operator(c)
+	case 'x', KEYCODE_DELETE: // x- delete chars under and after the cursor
+		g.op_apply('d', g.dot, g.char_span(g.dot, TernaryInt(g.cmdcnt < 1, 1, g.cmdcnt), 1), MOTION_EXCLUSIVE)
+	case 'X': // X- delete chars before the cursor
+		g.op_apply('d', g.char_span(g.dot, TernaryInt(g.cmdcnt < 1, 1, g.cmdcnt), -1), g.dot, MOTION_EXCLUSIVE)
+	case 'D', 'C': // D- delete to end of line, C- change to end of line
+		q := g.dot
+		for i := 1; i < g.cmdcnt; i++ {
+			q = g.next_line(q)
 		}
-		g.dot = g.end - 1
-		if g.cmdcnt > 0 {
-			g.dot = g.find_line(g.cmdcnt)
+		g.op_apply(TernaryInt(c == 'D', 'd', 'c'), g.dot, g.end_line(q), MOTION_EXCLUSIVE)
+	case 's': // s- substitute chars
+		g.op_apply('c', g.dot, g.char_span(g.dot, TernaryInt(g.cmdcnt < 1, 1, g.cmdcnt), 1), MOTION_EXCLUSIVE)
+	case 'S', 'Y': // S- substitute lines (cc), Y- yank lines (yy)
+		q := g.dot
+		for i := 1; i < g.cmdcnt; i++ {
+			q = g.next_line(q)
 		}
-		g.dot_skip_over_ws()
-	case 'h':
-		DoWhile(g.dot_left, func() bool { g.cmdcnt--; return g.cmdcnt <= 0 })
-	case 'j':
-		DoWhile(func() {
-			g.dot_next()
-			g.dot = g.move_to_col(g.dot, g.ccol)
-		}, func() bool { g.cmdcnt--; return g.cmdcnt <= 0 })
-	case 'k':
-		DoWhile(func() {
-			g.dot_prev()
-			g.dot = g.move_to_col(g.dot, g.ccol)
-		}, func() bool { g.cmdcnt--; return g.cmdcnt <= 0 })
-	case 'l':
-		DoWhile(g.dot_right, func() bool { g.cmdcnt--; return g.cmdcnt <= 0 })
+		g.op_apply(TernaryInt(c == 'S', 'c', 'y'), g.dot, q, MOTION_LINEWISE)
+	case '"': // "x- use register x for the next command
+		c1 := g.get_one_char()
+		if valid_reg_name(c1) {
+			g.cur_reg = c1
+		} else {
+			g.cmdcnt = 0
+		}
+	case 'p', 'P': // p- put after the cursor, P- put before
+		g.put(g.cur_reg, c == 'p', g.cmdcnt)
 	case 'O':
 		g.dot_begin()
 		g.dot = g.char_insert(g.dot, '\n')
@@ -575,30 +999,278 @@ key_cmd_mode:
 		g.cmd_mode = 1
 	case 'r': // r- replace the current char with user input
 		c1 := g.get_one_char() // get the replacement char
-		if g.text[g.dot] != '\n' {
-			g.text[g.dot] = byte(c1)
+		if c1 != 27 && g.text.at(g.dot) != '\n' {
+			g.string_delete(g.dot, g.next_rune(g.dot))
+			g.string_insert(g.dot, RuneToBytes(rune(c1)))
 		}
+	case 'v', 'V', VISUAL_BLOCK: // v- visual mode, V- by lines, ctrl-V- a block
+		g.visual_begin(c)
+	case KEY_G - 'v': // gv- select the last selection again
+		g.visual_again()
+	case KEY_G - 't', KEY_G - 'T': // gt- next tab page, or page N, gT- previous
+		g.tab_go(TernaryInt(c == KEY_G-'t', 1, -1), g.cmdcnt)
+	case 'm': // m{a-z}- mark the cursor position
+		if c1 := g.get_one_char(); valid_mark_name(c1) {
+			g.mark_set(c1, g.dot)
+		}
+	case 15: // ctrl-O  back on the jump list
+		g.jump_go(-1, g.cmdcnt)
+	case 9: // ctrl-I (tab)  forward on the jump list
+		g.jump_go(1, g.cmdcnt)
+	case 23: // ctrl-W  window commands
+		g.win_cmd(g.get_one_char(), g.cmdcnt)
+	case 30: // ctrl-^  edit the alternate file
+		g.edit_alternate(g.cmdcnt)
+	case 'q': // q{reg}- record keys into a register, q- stop
+		g.macro_record()
+	case '@': // @{reg}- run the keys in a register
+		g.macro_play(g.cmdcnt)
+	case '.': // .- repeat the last change
+		g.dot_repeat()
+	case '&': // &- repeat the last :s on this line
+		g.colon("s")
+	case 'u': // u- undo last change
+		g.undo_pop()
+	case 'U': // U- undo all changes on the last changed line
+		g.undo_line()
+	case 18: // ctrl-R  redo
+		g.redo_pop()
 	case '~': // ~- flip the case of letters   a-z -> A-Z
 		DoWhile(func() {
-			if unicode.IsLower(rune(g.text[g.dot])) {
-				g.text[g.dot] = byte(unicode.ToUpper(rune(g.text[g.dot])))
-			} else if unicode.IsUpper(rune(g.text[g.dot])) {
-				g.text[g.dot] = byte(unicode.ToLower(rune(g.text[g.dot])))
+			b, size := g.text.rune_at(g.dot)
+			if unicode.IsLower(b) || unicode.IsUpper(b) {
+				g.string_delete(g.dot, g.dot+size)
+				g.string_insert(g.dot, RuneToBytes(TernaryRune(unicode.IsLower(b),
+					unicode.ToUpper(b), unicode.ToLower(b))))
 			}
 			g.dot_right()
 		}, func() bool { g.cmdcnt--; return g.cmdcnt <= 0 })
 	}
 dc1:
-	if !unicode.IsDigit(rune(c)) {
+	if g.cmd_mode == 1 && mode != 1 {
+		g.insert_start = g.dot
+	}
+	g.change_end()
+	if !unicode.IsDigit(rune(c)) && c != '"' {
 		g.cmdcnt = 0
+		g.cur_reg = 0
+	}
+	if g.cmd_mode == 0 {
+		if !g.ioq_esc {
+			g.undo_close() // an insert session is one undo step
+		}
+		// in command mode the cursor is never on the '\n' of a non-empty line
+		if g.text.at(g.dot) == '\n' && g.dot > 0 && g.text.at(g.dot-1) != '\n' {
+			g.dot = g.prev_rune(g.dot)
+		}
+	}
+}
+
+// do_motion moves dot by the motion key c, g.cmdcnt times.
+// It returns the kind of the motion, MOTION_NONE if c is no motion.
+func (g *globals) do_motion(c int) int {
+	save := g.dot
+	kind := MOTION_EXCLUSIVE
+	cnt := TernaryInt(g.cmdcnt < 1, 1, g.cmdcnt)
+	switch c {
+	default:
+		return MOTION_NONE
+	case 'w', 'W', KEYCODE_CTRL_RIGHT, KEYCODE_SHIFT_RIGHT:
+		big := c == 'W'
+		for i := 0; i < cnt && g.dot < g.text.size(); i++ {
+			p := g.dot
+			g.dot = g.next_word(p, big)
+			if g.op_pending && i == cnt-1 && g.count_lines(p, g.dot) > 0 &&
+				g.end_line(p) > p {
+				// dw on the last word of a line stops at the line end
+				g.dot = g.end_line(p)
+			}
+		}
+	case 'b', 'B', KEYCODE_CTRL_LEFT, KEYCODE_SHIFT_LEFT:
+		for i := 0; i < cnt; i++ {
+			g.dot = g.prev_word(g.dot, c == 'B')
+		}
+	case 'e', 'E':
+		kind = MOTION_INCLUSIVE
+		for i := 0; i < cnt; i++ {
+			g.dot = g.end_word(g.dot, c == 'E')
+		}
+	case KEY_G - 'e', KEY_G - 'E':
+		kind = MOTION_INCLUSIVE
+		for i := 0; i < cnt; i++ {
+			g.dot = g.prev_word_end(g.dot, c == KEY_G-'E')
+		}
+	case ')':
+		for i := 0; i < cnt; i++ {
+			g.dot = g.next_sentence(g.dot)
+		}
+	case '(':
+		for i := 0; i < cnt; i++ {
+			g.dot = g.prev_sentence(g.dot)
+		}
+	case '}':
+		for i := 0; i < cnt; i++ {
+			g.dot = g.next_paragraph(g.dot)
+		}
+	case '{':
+		for i := 0; i < cnt; i++ {
+			g.dot = g.prev_paragraph(g.dot)
+		}
+	case '^': // first non-blank of the line
+		g.dot = g.first_nonblank(g.dot)
+		return kind
+	case '+', '\r', '-': // first non-blank cnt lines down/up
+		kind = MOTION_LINEWISE
+		for i := 0; i < cnt; i++ {
+			if c == '-' {
+				g.dot_prev()
+			} else {
+				g.dot_next()
+			}
+		}
+		if g.begin_line(g.dot) == g.begin_line(save) {
+			return MOTION_FAILED
+		}
+		g.dot = g.first_nonblank(g.dot)
+		return kind
+	case '|': // screen column cnt
+		g.dot = g.move_to_col(g.dot, cnt-1)
+		return kind
+	case 'H', 'M', 'L': // top, middle, bottom line of the screen
+		kind = MOTION_LINEWISE
+		g.dot = g.screenbegin
+		if c == 'L' {
+			g.dot = g.begin_line(g.end_screen())
+			if g.dot >= g.text.size() && g.dot > 0 {
+				g.dot = g.begin_line(g.dot - 1)
+			}
+			for i := 1; i < cnt && g.dot > g.screenbegin; i++ {
+				g.dot_prev()
+			}
+		} else {
+			n := cnt - 1
+			if c == 'M' {
+				n = g.count_lines(g.screenbegin, g.end_screen()) / 2
+			}
+			for i := 0; i < n; i++ {
+				g.dot_next()
+			}
+		}
+		g.dot = g.first_nonblank(g.dot)
+		return kind
+	case 'f', 'F', 't', 'T', ';', ',':
+		again := c == ';' || c == ','
+		if again {
+			if g.last_find_cmd == 0 {
+				return MOTION_FAILED
+			}
+			rev := c == ','
+			c = g.last_find_cmd
+			if rev {
+				c ^= 0x20 // f <-> F, t <-> T
+			}
+		} else {
+			g.last_find_cmd = c
+			g.last_find_char = g.get_one_char()
+			if g.last_find_char == 27 {
+				return MOTION_FAILED
+			}
+		}
+		if c == 'f' || c == 't' {
+			kind = MOTION_INCLUSIVE
+		}
+		p := g.find_char(g.dot, g.last_find_char, c, cnt, again)
+		if p < 0 {
+			return MOTION_FAILED
+		}
+		g.dot = p
+		return kind // t next to the char does not move, but dt still works
+	case '/', '?':
+		s := g.get_input_line(string(rune(c)))
+		if s == "" {
+			return MOTION_FAILED // cancelled
+		}
+		pat, off := search_split(s[1:], byte(c))
+		if pat != "" { // an empty pattern uses the last one
+			g.last_search_pattern = pat
+		}
+		if pat != "" || strings.IndexByte(s[1:], byte(c)) >= 0 {
+			g.last_search_offset = off
+		}
+		g.last_search_dir = TernaryInt(c == '/', 1, -1)
+		return g.do_search(1, cnt)
+	case 'n', 'N':
+		return g.do_search(TernaryInt(c == 'n', 1, -1), cnt)
+	case '\'', '`': // 'x- to the line of mark x, `x- to its char
+		p := g.mark_get(g.get_one_char())
+		if p < 0 {
+			g.status_line_bold("%v", err_mark_not_set)
+			return MOTION_FAILED
+		}
+		if c == '\'' {
+			g.dot = g.first_nonblank(p)
+			return MOTION_LINEWISE
+		}
+		g.dot = p
+		return kind
+	case '0', KEYCODE_HOME:
+		g.dot_begin()
+		return kind
+	case '$', KEYCODE_END:
+		for i := 1; i < g.cmdcnt; i++ {
+			g.dot_next()
+		}
+		g.dot_end()
+		return kind
+	case KEY_G - 'g', 'G':
+		if c == KEY_G-'g' && g.cmdcnt == 0 {
+			g.cmdcnt = 1
+		}
+		g.dot = g.begin_line(g.text.size() - 1)
+		if g.cmdcnt > 0 {
+			g.dot = g.find_line(g.cmdcnt)
+		}
+		g.dot_skip_over_ws()
+		return MOTION_LINEWISE
+	case 'h', KEYCODE_LEFT:
+		DoWhile(g.dot_left, func() bool { g.cmdcnt--; return g.cmdcnt <= 0 })
+	case 'j', KEYCODE_DOWN, 'k', KEYCODE_UP:
+		// the column the cursor is shown in, the end of a tab;
+		// not g.ccol, there is no refresh between keys of a macro
+		kind = MOTION_LINEWISE
+		col := g.col_of(g.dot)
+		if g.text.at(g.dot) == '\t' {
+			col = g.next_tabstop(col)
+		}
+		DoWhile(func() {
+			if c == 'j' || c == KEYCODE_DOWN {
+				g.dot_next()
+			} else {
+				g.dot_prev()
+			}
+			g.dot = g.move_to_col(g.dot, col)
+		}, func() bool { g.cmdcnt--; return g.cmdcnt <= 0 })
+	case 'l', KEYCODE_RIGHT:
+		if g.op_pending { // dl may take the last char of the line
+			g.dot = g.char_span(g.dot, TernaryInt(g.cmdcnt < 1, 1, g.cmdcnt), 1)
+			break
+		}
+		DoWhile(g.dot_right, func() bool { g.cmdcnt--; return g.cmdcnt <= 0 })
+	}
+	if g.dot >= g.text.size() && !g.op_pending {
+		g.dot = TernaryInt(g.text.size() > 0, g.text.size()-1, 0)
 	}
+	if g.dot == save {
+		return MOTION_FAILED
+	}
+	return kind
 }
 
 func (g *globals) dot_skip_over_ws() {
-	b := g.text[g.dot]
-	for unicode.IsSpace(rune(b)) && b != '\n' && g.dot < g.end-1 {
+	b := g.text.at(g.dot)
+	for unicode.IsSpace(rune(b)) && b != '\n' && g.dot < g.text.size()-1 {
 		g.dot++
-		b = g.text[g.dot]
+		b = g.text.at(g.dot)
 	}
 }
 
@@ -609,31 +1281,233 @@ func (g *globals) colon(c string) {
 	if c[0] == ':' {
 		c = c[1:]
 	}
-	if strings.HasPrefix(c, "quit") || strings.HasPrefix(c, "q!") {
-		g.editing = 0
+	r, c, err := g.ex_get_range(c)
+	cmd, bang, arg := ex_split(c)
+	if err == err_invalid_range && ex_arg_move(cmd) {
+		err = nil // :5n is a count of files, not a line
+	}
+	if err != nil {
+		g.status_line_bold("%v", err)
+		return
+	}
+	if ex_abbrev(cmd, "s", "substitute") || (cmd == "" && strings.HasPrefix(arg, "&")) {
+		// the pattern and replacement may have blanks at the end
+		raw := strings.TrimLeft(c, " \t")[len(cmd):]
+		if cmd == "" {
+			raw = strings.TrimLeft(raw, " \t")[1:] // :& and :&&
+		}
+		g.ex_substitute(r, raw)
+		return
+	}
+	if ex_abbrev(cmd, "g", "global") || ex_abbrev(cmd, "v", "vglobal") {
+		g.ex_global(r, arg, bang || cmd[0] == 'v')
+		return
+	}
+	if ex_abbrev(cmd, "d", "delete") || ex_abbrev(cmd, "y", "yank") {
+		g.ex_delete_yank(TernaryInt(cmd[0] == 'd', 'd', 'y'), r, arg)
 		return
 	}
-	if strings.HasPrefix(c, "write") || strings.HasPrefix(c, "wq") || c == "x" {
-		var err error
-		if g.modified_count != 0 || c != "x" {
-			err = g.file_write(g.current_filename, g.text[:g.end])
+	if ex_abbrev(cmd, "m", "move") || cmd == "t" || ex_abbrev(cmd, "co", "copy") {
+		g.ex_move_copy(cmd[0] == 'm', r, arg)
+		return
+	}
+	if ex_abbrev(cmd, "j", "join") {
+		g.ex_join(r, !bang, arg)
+		return
+	}
+	if cmd == "" && (strings.HasPrefix(arg, ">") || strings.HasPrefix(arg, "<")) {
+		g.ex_shift(r, arg)
+		return
+	}
+	if ex_abbrev(cmd, "norm", "normal") {
+		keys := strings.TrimLeft(c, " \t")[len(cmd)+TernaryInt(bang, 1, 0):]
+		g.ex_normal(r, strings.TrimLeft(keys, " \t"))
+		return
+	}
+	if cmd == "" && arg == "=" { // :=  print the line number
+		g.status_line("%d", TernaryInt(r.naddr > 0, r.last, g.line_count()))
+		return
+	}
+	if cmd == "" && arg == "" && r.naddr > 0 { // :N  go to line N
+		g.jump_push(g.dot)
+		g.dot = g.first_nonblank(g.find_line(TernaryInt(r.last < 1, 1, r.last)))
+		return
+	}
+	if ex_abbrev(cmd, "pu", "put") {
+		name := 0
+		if arg != "" {
+			name = int(arg[0])
+		}
+		if r.naddr > 0 {
+			g.dot = g.find_line(r.last)
 		}
-		if err != nil {
-			g.status_line_bold("Write error: %v", err)
+		if r.naddr > 0 && r.last == 0 { // :0put goes above line 1
+			g.ex_put(name, true)
 		} else {
-			g.modified_count = 0
-			g.status_line("%s %dL %dC written",
-				g.current_filename, g.count_lines(g.text[:g.end]), g.end)
-			if c == "x" || c[1] == 'q' {
-				g.editing = 0
-			}
+			g.ex_put(name, bang)
+		}
+		return
+	}
+	if ex_abbrev(cmd, "reg", "registers") || ex_abbrev(cmd, "di", "display") {
+		g.show_registers(strings.Replace(arg, " ", "", -1))
+		return
+	}
+	if ex_abbrev(cmd, "e", "edit") {
+		g.ex_edit(arg, bang)
+		return
+	}
+	if ex_arg_move(cmd) {
+		n, _ := strconv.Atoi(arg) // :n 2 or :2n
+		if n < 1 {
+			n = TernaryInt(r.naddr > 0 && r.last > 0, r.last, 1)
+		}
+		g.ex_next(TernaryInt(cmd[0] == 'n', n, -n), 0, bang)
+		return
+	}
+	if ex_abbrev(cmd, "rew", "rewind") || ex_abbrev(cmd, "fir", "first") || ex_abbrev(cmd, "la", "last") {
+		g.ex_next(0, TernaryInt(cmd[0] == 'l', 1, -1), bang)
+		return
+	}
+	if ex_abbrev(cmd, "ar", "args") {
+		g.ex_args(arg, bang)
+		return
+	}
+	if cmd == "ls" || ex_abbrev(cmd, "buffers", "buffers") || ex_abbrev(cmd, "files", "files") {
+		g.ex_ls()
+		return
+	}
+	if ex_abbrev(cmd, "b", "buffer") {
+		g.ex_buffer(arg, bang)
+		return
+	}
+	if ex_abbrev(cmd, "bn", "bnext") || ex_abbrev(cmd, "bp", "bprevious") || ex_abbrev(cmd, "bN", "bNext") {
+		n, _ := strconv.Atoi(arg)
+		g.ex_bnext(TernaryInt(cmd[1] == 'n', 1, -1), n, bang)
+		return
+	}
+	if ex_abbrev(cmd, "bd", "bdelete") {
+		g.ex_bdelete(arg, bang)
+		return
+	}
+	if ex_abbrev(cmd, "sp", "split") || ex_abbrev(cmd, "vs", "vsplit") ||
+		cmd == "new" || ex_abbrev(cmd, "vne", "vnew") {
+		g.ex_window_split(cmd[0] == 'v', cmd == "new" || cmd[0] == 'v' && cmd[1] == 'n', arg)
+		return
+	}
+	if ex_abbrev(cmd, "clo", "close") {
+		g.win_close(bang)
+		return
+	}
+	if ex_abbrev(cmd, "on", "only") {
+		g.win_only(bang)
+		return
+	}
+	if ex_abbrev(cmd, "tabnew", "tabnew") || ex_abbrev(cmd, "tabe", "tabedit") {
+		g.tab_new(arg)
+		return
+	}
+	if ex_abbrev(cmd, "tabc", "tabclose") {
+		g.tab_close(arg, bang)
+		return
+	}
+	if ex_abbrev(cmd, "tabn", "tabnext") || ex_abbrev(cmd, "tabp", "tabprevious") || ex_abbrev(cmd, "tabN", "tabNext") {
+		n, _ := strconv.Atoi(arg)
+		g.tab_go(TernaryInt(cmd[3] == 'n', 1, -1), n)
+		return
+	}
+	if cmd == "tabs" {
+		g.tab_list()
+		return
+	}
+	if ex_abbrev(cmd, "se", "set") {
+		g.ex_set(arg)
+		return
+	}
+	if ex_abbrev(cmd, "q", "quit") && (g.frame_root.win == nil || len(g.tabs) > 1) && bang {
+		g.buffer_discard(g.buffer, 1) // :q! throws the changes away, :clo! keeps them
+	}
+	if ex_abbrev(cmd, "q", "quit") && g.frame_root.win == nil { // other windows stay
+		g.win_close(bang)
+		return
+	}
+	if ex_abbrev(cmd, "q", "quit") && len(g.tabs) > 1 { // the last window of a tab page
+		g.tab_close("", bang)
+		return
+	}
+	if ex_abbrev(cmd, "q", "quit") {
+		if g.modified_count != 0 && !bang {
+			g.status_line_bold("No write since last change (:%s! overrides)", cmd)
+			return
+		}
+		if b := g.buffer_hidden_changed(); b != nil && !bang {
+			g.status_line_bold("No write since last change for buffer \"%s\"",
+				TernaryString(b.current_filename == "", "[No Name]", b.current_filename))
+			return
+		}
+		if !bang && g.more_files() {
+			return
+		}
+		g.editing = 0
+		return
+	}
+	if ex_abbrev(cmd, "w", "write") || cmd == "wq" || ex_abbrev(cmd, "x", "xit") {
+		fn := TernaryString(arg != "", arg, g.current_filename)
+		if (g.modified_count != 0 || cmd[0] != 'x') && !g.file_save(fn) {
+			return
+		}
+		if (cmd[0] == 'x' || cmd == "wq") && g.frame_root.win == nil {
+			g.win_close(false)
+		} else if (cmd[0] == 'x' || cmd == "wq") && len(g.tabs) > 1 {
+			g.tab_close("", false)
+		} else if (cmd[0] == 'x' || cmd == "wq") && (bang || !g.more_files()) {
+			g.editing = 0
 		}
 		return
 	}
+	if cmd != "" || arg != "" {
+		g.status_line_bold("Not an editor command: %s", c)
+	}
 }
 
-func (g *globals) count_lines(cnt []byte) int {
-	return strings.Count(BytesToStr(cnt), "\n")
+// more_files warns that the argument list has files left to edit,
+// once: a second :q or :x quits
+func (g *globals) more_files() bool {
+	n := len(g.args) - 1 - g.arg_idx
+	if n <= 0 || g.quit_warned {
+		return false
+	}
+	g.quit_warned = true
+	g.status_line_bold("%d more file%s to edit", n, TernaryString(n > 1, "s", ""))
+	return true
+}
+
+// :n :N :prev, which take a count
+func ex_arg_move(cmd string) bool {
+	return ex_abbrev(cmd, "n", "next") || ex_abbrev(cmd, "N", "Next") || ex_abbrev(cmd, "prev", "previous")
+}
+
+// split an ex command into its name, a '!' after it and the argument
+func ex_split(c string) (string, bool, string) {
+	c = strings.TrimLeft(c, " \t")
+	i := 0
+	for i < len(c) && unicode.IsLetter(rune(c[i])) {
+		i++
+	}
+	cmd, rest := c[:i], c[i:]
+	bang := strings.HasPrefix(rest, "!")
+	if bang {
+		rest = rest[1:]
+	}
+	return cmd, bang, strings.TrimSpace(rest)
+}
+
+// is cmd name, or an abbreviation of it at least as long as short
+func ex_abbrev(cmd, short, name string) bool {
+	return len(cmd) >= len(short) && strings.HasPrefix(name, cmd)
+}
+
+func (g *globals) count_lines(start, stop int) int {
+	return g.text.line_of(stop) - g.text.line_of(start)
 }
 
 func (g *globals) status_line_bold(f string, a ...interface{}) {
@@ -646,53 +1520,77 @@ func (g *globals) status_line(f string, a ...interface{}) {
 	fmt.Fprintf(&g.status_buffer, f, a...)
 }
 
+// write the text to file fn, reporting it on the status line
+func (g *globals) file_save(fn string) bool {
+	if err := g.file_write(fn, g.text.slice(0, g.text.size())); err != nil {
+		g.status_line_bold("Write error: %v", err)
+		return false
+	}
+	if fn == g.current_filename {
+		g.undo_saved()
+	}
+	g.status_line("%s %dL %dC written",
+		fn, g.count_lines(0, g.text.size()), g.text.size())
+	return true
+}
+
 func (g *globals) file_write(f string, cnt []byte) error {
 	return ioutil.WriteFile(f, cnt, 0666)
 }
 
 func (g *globals) query_screen_dimensions() {
-	var winsize = &struct {
-		Row    uint16
-		Col    uint16
-		Xpixel uint16
-		Ypixel uint16
-	}{}
-	retCode, _, _ := syscall.Syscall(syscall.SYS_IOCTL,
-		uintptr(syscall.Stdin),
-		uintptr(syscall.TIOCGWINSZ),
-		uintptr(unsafe.Pointer(winsize)))
-
-	if int(retCode) == -1 {
-	} else {
-		g.rows = int(winsize.Row)
-		g.columns = int(winsize.Col)
+	if rows, cols, ok := g.term.size(); ok {
+		g.rows, g.columns = rows, cols
 	}
 }
 
-func (g *globals) text_hole_make(p int, size int) int {
-	var bias int = 0
-	if size <= 0 {
-		return bias
+// open a hole of size bytes at p for the caller to fill
+func (g *globals) text_hole_make(p int, size int) []byte {
+	for _, m := range g.marked {
+		m.insert(g.text, p)
 	}
-	g.end += size
-	log.Printf("g.end - %d", g.end)
-	if g.end >= len(g.text) {
-		new_text := make([]byte, g.end+10240)
-		copy(new_text, g.text)
-		g.text = new_text
+	g.mark_insert(p, size)
+	return g.text.hole(p, size)
+}
+
+// remove text[p:q]
+func (g *globals) text_hole_delete(p int, q int) {
+	for _, m := range g.marked {
+		m.delete(g.text, p, q)
 	}
-	copy(g.text[p+size:], g.text[p:g.end-size])
-	/*for i := 0; i < size; i++ {
-		g.text[p+i] = ' '
-	}*/
-	return bias
+	g.mark_delete(p, q)
+	g.text.delete(p, q-p)
 }
 
-func (g *globals) stupid_insert(p int, c int) int {
-	bias := g.text_hole_make(p, 1)
-	p += bias
-	g.text[p] = byte(c)
-	return bias
+// insert s at p, logging it for undo. Returns the end of the new text.
+func (g *globals) string_insert(p int, s []byte) int {
+	if len(s) == 0 {
+		return p
+	}
+	g.undo_push(p, append([]byte(nil), s...), UNDO_INS)
+	copy(g.text_hole_make(p, len(s)), s)
+	g.modified_count++
+	g.changes++
+	g.mark_set('.', p)
+	if b, ok := g.marks['[']; !ok || b > p || g.marks[']']+1 != p {
+		g.mark_set('[', p) // not typed on after the last change
+	}
+	g.mark_set(']', p+len(s)-1)
+	return p + len(s)
+}
+
+// delete text[p:q], logging it for undo
+func (g *globals) string_delete(p int, q int) int {
+	if q <= p {
+		return p
+	}
+	g.undo_push(p, g.text.copy_out(p, q), UNDO_DEL)
+	g.text_hole_delete(p, q)
+	g.modified_count++
+	g.changes++
+	g.mark_set('.', p)
+	g.mark_changed(p, p)
+	return p
 }
 
 func (g *globals) file_insert(f string, p int, initial bool) int {
@@ -703,8 +1601,8 @@ func (g *globals) file_insert(f string, p int, initial bool) int {
 	if p < 0 {
 		p = 0
 	}
-	if p > g.end {
-		p = g.end
+	if p > g.text.size() {
+		p = g.text.size()
 	}
 	file, err = os.Open(f)
 	if err != nil {
@@ -715,33 +1613,180 @@ func (g *globals) file_insert(f string, p int, initial bool) int {
 	defer file.Close()
 	stat, _ := file.Stat()
 	var size = int(stat.Size())
-	n := g.text_hole_make(p, size)
-	cnt, err = file.Read(g.text[p : p+size])
+	cnt, err = io.ReadFull(file, g.text_hole_make(p, size))
 	if err != nil {
-	} else if cnt < n {
+		g.text_hole_delete(p+cnt, p+size)
 	}
 	return cnt
 }
 
 func (g *globals) char_insert(p int, c int) int {
 	if c == 27 { // Is this an ESC?
+		if g.block_ins.lines > 0 {
+			g.block_insert_done(p)
+		}
 		g.cmd_mode = 0
 		g.cmdcnt = 0
+		if p > 0 && g.text.at(p-1) != '\n' {
+			p = g.prev_rune(p) // back onto the last char typed
+		}
+	} else if c == g.erase_char || c == 8 || c == 127 { // backspace
+		if p > 0 {
+			q := g.prev_rune(p)
+			g.string_delete(q, p)
+			p = q
+		}
+	} else if c == 23 || c == 21 { // ctrl-W delete a word, ctrl-U all typed on the line
+		q := g.insert_erase_to(p, c == 21)
+		g.string_delete(q, p)
+		p = q
+		g.insert_start = TernaryInt(g.insert_start > p, p, g.insert_start)
+	} else if c == 20 || c == 4 { // ctrl-T ctrl-D shift the line, keeping the cursor on its char
+		b := g.begin_line(p)
+		fromend := g.end_line(p) - p
+		g.shift_indent(b, TernaryInt(c == 20, 1, -1))
+		p = g.end_line(b) - fromend
+		p = TernaryInt(p < b, b, p)
+	} else if c == 18 { // ctrl-R insert a register
+		if r := g.reg_get(g.get_one_char()); r != nil {
+			p = g.string_insert(p, r.text)
+		}
+	} else if c == 22 { // ctrl-V insert the next key as it is, or a char code
+		if r := g.insert_literal(); r >= 0 {
+			p = g.string_insert(p, RuneToBytes(r))
+		}
 	} else {
 		if c == '\r' {
 			c = '\n'
 		}
-		g.modified_count++
-		p += 1 + g.stupid_insert(p, c)
+		p = g.string_insert(p, RuneToBytes(rune(c)))
+	}
+	return p
+}
+
+// where ctrl-W (or ctrl-U with line set) typed at p stops deleting:
+// at the start of the insert, then at the indent, then at the line start.
+// Before a '\n' it deletes the '\n'.
+func (g *globals) insert_erase_to(p int, line bool) int {
+	b := g.begin_line(p)
+	if p == b {
+		return TernaryInt(p > 0, p-1, p)
+	}
+	q := p
+	if line {
+		q = b
+		if fnb := g.first_nonblank(b); fnb < p {
+			q = fnb
+		}
+	} else {
+		for q > b && g.char_class(q-1, false) == 0 {
+			q--
+		}
+		if q > b {
+			cl := g.char_class(g.prev_rune(q), false)
+			for q > b && g.char_class(g.prev_rune(q), false) == cl {
+				q = g.prev_rune(q)
+			}
+		}
+	}
+	if p > g.insert_start && q < g.insert_start && g.insert_start >= b {
+		q = g.insert_start
+	}
+	return q
+}
+
+// the key after ctrl-V: a char to insert as it is, or a code typed
+// as up to 3 decimal digits, o and 3 octal, x and 2, u and 4 or
+// U and 8 hex digits. A key ending a code early is used as typed.
+// Returns -1 for function keys.
+func (g *globals) insert_literal() rune {
+	c := g.get_one_char()
+	base, max := 10, 3
+	switch c {
+	case 'o', 'O':
+		base = 8
+	case 'x', 'X':
+		base, max = 16, 2
+	case 'u':
+		base, max = 16, 4
+	case 'U':
+		base, max = 16, 8
+	default:
+		if c < '0' || c > '9' {
+			return rune(TernaryInt(c < 0 || c > unicode.MaxRune, -1, c))
+		}
+		g.ioq = append([]int{c}, g.ioq...) // the first digit
+	}
+	n, digits := 0, 0
+	for ; digits < max; digits++ {
+		d := g.get_one_char()
+		v := strings.IndexByte("0123456789abcdef", byte(unicode.ToLower(rune(d))))
+		if d < 0 || d > 'z' || v < 0 || v >= base || (base == 10 && n*10+v > 255) {
+			g.ioq = append([]int{d}, g.ioq...)
+			break
+		}
+		n = n*base + v
+	}
+	if digits == 0 {
+		return rune(c) // "x" and such with no digits
+	}
+	return rune(n)
+}
+
+// char_replace handles key c in replace mode: c takes the place of
+// the char at p, or is added at the end of a line. Backspace puts
+// back what was typed over, back to where R started.
+func (g *globals) char_replace(p int, c int) int {
+	switch {
+	case c == 27:
+		typed := g.text.copy_out(g.replace_start, TernaryInt(p > g.replace_start, p, g.replace_start))
+		for i := 1; i < g.replace_cnt; i++ { // 3Rab<ESC>
+			for _, r := range string(typed) {
+				p = g.char_replace(p, int(r))
+			}
+		}
+		g.replace_saved = g.replace_saved[:0]
+		return g.char_insert(p, c)
+	case c == g.erase_char || c == 8 || c == 127:
+		if p <= g.replace_start || len(g.replace_saved) == 0 {
+			if p > 0 && g.text.at(p-1) != '\n' {
+				p = g.prev_rune(p)
+			}
+			return p
+		}
+		old := g.replace_saved[len(g.replace_saved)-1]
+		g.replace_saved = g.replace_saved[:len(g.replace_saved)-1]
+		q := g.prev_rune(p)
+		g.string_delete(q, p)
+		g.string_insert(q, old)
+		return q
+	case c == '\r' || c == '\n': // a line break is added, not typed over
+		g.replace_saved = append(g.replace_saved, nil)
+		return g.string_insert(p, []byte{'\n'})
+	case c > 0 && strconv.IsPrint(rune(c)) || c == '\t':
+		var old []byte
+		if p < g.text.size() && g.text.at(p) != '\n' {
+			old = g.text.copy_out(p, g.next_rune(p))
+		}
+		g.replace_saved = append(g.replace_saved, old)
+		return g.replace_rune(p, rune(c))
 	}
 	return p
 }
 
+// put r in place of the char at p, or before the '\n' at the end of
+// the line. Returns the position after it.
+func (g *globals) replace_rune(p int, r rune) int {
+	if p < g.text.size() && g.text.at(p) != '\n' {
+		g.string_delete(p, g.next_rune(p))
+	}
+	return g.string_insert(p, RuneToBytes(r))
+}
+
 func (g *globals) init_text_buffer(f string) {
-	g.text = make([]byte, 10240)
+	g.text = new_text_buffer(0)
 	g.screenbegin = 0
 	g.dot = 0
-	g.end = 0
 	if f != g.current_filename {
 		g.current_filename = f
 	}
@@ -749,89 +1794,135 @@ func (g *globals) init_text_buffer(f string) {
 	if rc < 0 {
 		g.char_insert(g.dot, '\n')
 	}
+	g.undo_reset()
 	g.modified_count = 0
+	g.marks, g.jumps, g.jump_idx = nil, nil, 0
+}
+
+func (g *globals) edit_file(f string) error {
+	g.edit_init(f)
+	for g.editing > 0 {
+		g.edit_step()
+	}
+	g.cookmode()
+	return g.read_err
 }
 
-func (g *globals) edit_file(f string) {
-	g.editing = 1 // 0 = exit, 1 = one file, 2 = multiple files
+// set up the screen and the first buffer, on file f
+func (g *globals) edit_init(f string) {
+	g.editing = TernaryInt(len(g.args) > 1, 2, 1) // 0 = exit, 1 = one file, 2 = multiple files
 	g.rawmode()
+	g.out.hide_cursor = true
+	g.out_printf(ESC_SYNC_QUERY)
 	g.rows = 24
 	g.columns = 80
 	g.query_screen_dimensions()
 	g.new_screen(g.rows, g.columns)
+	g.buffer = g.buffer_new(f)
 	g.init_text_buffer(f)
+	g.win_init()
 
 	g.crow = 0
 	g.ccol = 0
 	g.cmd_mode = 0 // 0=command  1=insert  2='R'eplace
 	g.tabstop = 8
+	g.shiftwidth = 8
 	g.redraw(false)
+}
 
-	var c int
-	for g.editing > 0 {
-		c = g.get_one_char()
-		g.last_input_char = byte(c)
-		g.do_cmd(c)
-		if g.readbuffer[0] == 0 {
-			g.refresh(false)
-			g.show_status_line()
-		}
+// read a key and run it, redrawing the screen when no more keys wait
+func (g *globals) edit_step() {
+	c := g.get_one_char()
+	g.last_input_char = byte(c)
+	g.do_cmd(c)
+	if !g.input_ready() {
+		g.refresh(false)
+		g.show_status_line()
 	}
-	g.cookmode()
 }
 
 //----- IO Routines --------------------------------------------
 func (g *globals) get_one_char() int {
-	var c [1]byte
-	n, err := os.Stdin.Read(c[:])
-	if err != nil || n != 1 {
-		log.Printf("read n %v, err %v", n, err)
-		g.cookmode()
-		os.Exit(1)
+	if len(g.ioq) > 0 {
+		c := g.ioq[0]
+		g.ioq = g.ioq[1:]
+		g.cmd_keys = append(g.cmd_keys, c)
+		return c
+	}
+	if g.ioq_esc {
+		return 27
+	}
+	for !g.input_ready() {
+		if g.read_err != nil {
+			g.editing = 0 // no more keys, leave as :q! does
+			return 27
+		}
+		if g.screen_dirty {
+			g.screen_dirty = false
+			g.redraw(true)
+			g.show_status_line()
+			if g.repaint != nil {
+				g.repaint()
+			}
+		}
+		g.out_flush()                          // the frame is drawn, wait for a key
+		g.input, g.read_err = g.wait_input(-1) // nil after a resize
+	}
+	c := g.read_key()
+	g.cmd_keys = append(g.cmd_keys, c)
+	if g.recording != 0 {
+		g.rec_keys = append(g.rec_keys, c)
 	}
-	return int(c[0])
+	return c
 }
 
 // Get input line (uses "status line" area)
 func (g *globals) get_input_line(prompt string) string {
-	buf := g.get_input_line__buf
-	copy(buf[:], prompt)
-	g.go_bottom_and_clear_to_eol()
-	fmt.Printf(prompt)
+	buf := g.get_input_line__buf[:]
+	i := copy(buf, []rune(prompt))
+	old := g.repaint
+	g.repaint = func() {
+		g.go_bottom_and_clear_to_eol()
+		g.out_printf("%s", string(buf[:i]))
+	}
+	g.repaint()
 
 	var c int
-	i := len(prompt)
 	for i < MAX_INPUT_LEN {
 		c = g.get_one_char()
-		if c == '\n' || c == '\r' || c == 27 {
+		if c == '\n' || c == '\r' {
+			break
+		}
+		if c == 27 { // cancelled
+			i = 0
 			break
 		}
 		if c == g.erase_char || c == 8 || c == 127 {
 			i--
+			g.out_printf("%s", strings.Repeat("\b \b", RuneWidth(buf[i])))
 			buf[i] = ' '
-			fmt.Printf("\b \b")
 			if i <= 0 {
 				break
 			}
-		} else if c > 0 && c < 256 {
-			buf[i] = byte(c)
+		} else if c > 0 && c != utf8.RuneError {
+			buf[i] = rune(c)
 			i++
-			fmt.Printf("%s", string(byte(c)))
+			g.out_printf("%s", string(rune(c)))
 		}
 	}
+	g.repaint = old
 	g.refresh(false)
 	return string(buf[:i])
 }
 
 //----- Set terminal attributes --------------------------------
 func (g *globals) rawmode() error {
-	SetTermiosToRaw(int(os.Stdin.Fd()), &g.term_orig, TERMIOS_RAW_CRNL)
-	g.erase_char = int(g.term_orig.Cc[syscall.VERASE])
+	g.erase_char = g.term.raw_mode()
 	return nil
 }
 
 func (g *globals) cookmode() {
-	SetTermios(os.Stdin.Fd(), &g.term_orig)
+	g.term.cooked_mode()
 }
 
 func main() {
@@ -845,20 +1936,24 @@ func main() {
 	// syscall.Dup3(int(file.Fd()), int(os.Stderr.Fd()), 0)
 	// var c int
 	var g globals
-	g.init()
+	g.init(new_tty_terminal(os.Stdin, os.Stdout))
 
 	//----- This is the main file handling loop --------------
 	// "Save cursor, use alternate screen buffer, clear screen"
-	fmt.Printf(ESC + "[?1049h")
-	if len(os.Args) > 1 {
-		for i := 1; i < len(os.Args); i++ {
-			g.edit_file(os.Args[i])
-		}
+	g.out_printf(ESC + "[?1049h")
+	g.args = os.Args[1:]
+	if len(g.args) > 0 {
+		err = g.edit_file(g.args[0])
 	} else {
-		g.edit_file("")
+		err = g.edit_file("")
 	}
 	// "Use normal screen buffer, restore cursor"
-	fmt.Printf(ESC + "[?1049l")
+	g.out_printf(ESC + "[?1049l")
+	g.out_flush()
 	//-----------------------------------------------------------
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	os.Exit(0)
 }
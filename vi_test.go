@@ -0,0 +1,500 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// an editor on a 10 x 40 virtual terminal, editing a file holding text
+func new_test_editor(t *testing.T, text string) (*globals, *virtual_terminal) {
+	log.SetOutput(io.Discard)
+	fn := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(fn, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vt := new_virtual_terminal(10, 40)
+	g := &globals{}
+	g.init(vt)
+	g.edit_init(fn)
+	g.out_flush()
+	return g, vt
+}
+
+// run keys as if typed, until all of them are used
+func type_keys(g *globals, keys string) {
+	go func() { g.events <- event{kind: EVENT_INPUT, input: []byte(keys)} }()
+	g.edit_step()
+	for g.input_ready() {
+		g.edit_step()
+	}
+	g.out_flush()
+}
+
+func text_of(g *globals) string {
+	return string(g.text.copy_out(0, g.text.size()))
+}
+
+func screen_lines(vt *virtual_terminal, from, to int) []string {
+	var l []string
+	for r := from; r < to; r++ {
+		l = append(l, vt.line(r))
+	}
+	return l
+}
+
+func check_lines(t *testing.T, vt *virtual_terminal, from int, want ...string) {
+	t.Helper()
+	got := screen_lines(vt, from, from+len(want))
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("screen rows %d-%d:\n%q\nwant\n%q", from, from+len(want)-1, got, want)
+		}
+	}
+}
+
+func TestEditAndDraw(t *testing.T) {
+	g, vt := new_test_editor(t, "one\ntwo\nthree\n")
+	type_keys(g, "jxjAs\x1b")
+	if got := text_of(g); got != "one\nwo\nthrees\n" {
+		t.Fatalf("text %q", got)
+	}
+	check_lines(t, vt, 0, "1 one", "2 wo", "3 threes", "~")
+	if r, c := vt.cursor(); r != 2 || c != 7 {
+		t.Fatalf("cursor at %d,%d, want 2,7", r, c)
+	}
+}
+
+// ESC typed quickly before d or backspace still leaves insert mode
+func TestEscThenKey(t *testing.T) {
+	g, _ := new_test_editor(t, "one\ntwo\n")
+	type_keys(g, "ix\x1bdd")
+	if got := text_of(g); got != "two\n" || g.cmd_mode != 0 {
+		t.Fatalf("text %q, mode %d", got, g.cmd_mode)
+	}
+	type_keys(g, "A!\x1b\x7f")
+	if got := text_of(g); got != "two!\n" || g.cmd_mode != 0 {
+		t.Fatalf("text %q, mode %d", got, g.cmd_mode)
+	}
+	// a read of its own is an Alt key
+	for keys, want := range map[string]int{"\x1bd": KEYCODE_ALT_D, "\x1b\x7f": KEYCODE_ALT_BACKSPACE} {
+		go func(keys string) { g.events <- event{kind: EVENT_INPUT, input: []byte(keys)} }(keys)
+		if k := g.read_key(); k != want {
+			t.Fatalf("%q read as %d, want %d", keys, k, want)
+		}
+	}
+}
+
+// a lone ESC waits for the timer, a failed read ends the editing
+func TestEscTimeoutAndReadError(t *testing.T) {
+	g, vt := new_test_editor(t, "one\n")
+	type_keys(g, "ix\x1b")
+	if got := text_of(g); got != "xone\n" || g.cmd_mode != 0 {
+		t.Fatalf("text %q, mode %d", got, g.cmd_mode)
+	}
+	type_keys(g, "iy")
+	vt.close()
+	for g.editing > 0 {
+		g.edit_step()
+	}
+	if g.read_err != io.EOF || g.cmd_mode != 0 || text_of(g) != "yxone\n" {
+		t.Fatalf("err %v, mode %d, text %q", g.read_err, g.cmd_mode, text_of(g))
+	}
+}
+
+func TestReplaceCount(t *testing.T) {
+	g, _ := new_test_editor(t, "abcdef\n")
+	type_keys(g, "2Rx\ry\x1b")
+	if got := text_of(g); got != "x\nyx\nyef\n" {
+		t.Fatalf("text %q", got)
+	}
+}
+
+func TestStatusLine(t *testing.T) {
+	g, vt := new_test_editor(t, "one\n")
+	type_keys(g, ":foo\r")
+	check_lines(t, vt, 9, "Not an editor command: foo")
+	if vt.cell(9, 0)&SCR_INVERSE == 0 {
+		t.Fatal("error message not inverse")
+	}
+	type_keys(g, "v")
+	check_lines(t, vt, 9, "-- VISUAL --")
+}
+
+func TestVisualSelection(t *testing.T) {
+	g, vt := new_test_editor(t, "abcdef\n")
+	type_keys(g, "lvl")
+	for c, inv := range []bool{false, false, false, true, true, false} {
+		if (vt.cell(0, c)&SCR_INVERSE != 0) != inv {
+			t.Fatalf("cell %d of %q inverse %v, want %v", c, vt.line(0), !inv, inv)
+		}
+	}
+	type_keys(g, "d")
+	if got := text_of(g); got != "adef\n" {
+		t.Fatalf("text %q", got)
+	}
+	check_lines(t, vt, 0, "1 adef")
+}
+
+func TestSearch(t *testing.T) {
+	g, _ := new_test_editor(t, "aaaa\nab cd\n")
+	for _, s := range []struct {
+		keys string
+		dot  int
+	}{
+		{"/aa\r", 1}, {"n", 2}, {"n", 0}, // matches may overlap
+		{"$?aa\r", 2}, {"n", 1}, {"n", 0}, {"n", 2},
+		{"j0/\\<\r", 8}, {"0/\\>\r", 7}, {"b/\\<\r", 8},
+		{"gg/^a\r", 5}, // not the a after the cursor
+	} {
+		type_keys(g, s.keys)
+		if g.dot != s.dot {
+			t.Fatalf("%q: dot %d, want %d", s.keys, g.dot, s.dot)
+		}
+	}
+	type_keys(g, ":%s/\\<a/x/g\r")
+	if got := text_of(g); got != "xaaa\nxb cd\n" {
+		t.Fatalf("text %q", got)
+	}
+}
+
+func TestSubstituteThenN(t *testing.T) {
+	g, _ := new_test_editor(t, "f1\nx\nf2\nx\nf3\n")
+	type_keys(g, ":s/f/F/\rn")
+	if l := g.line_of(g.dot); l != 3 {
+		t.Fatalf("n went to line %d, want 3", l)
+	}
+}
+
+// each case starts from its own text, keys are typed in command mode
+type edit_case struct {
+	text, keys, want string
+}
+
+func check_edits(t *testing.T, cases []edit_case) {
+	t.Helper()
+	for _, c := range cases {
+		g, _ := new_test_editor(t, c.text)
+		type_keys(g, c.keys)
+		if got := text_of(g); got != c.want {
+			t.Errorf("%q on %q: %q, want %q", c.keys, c.text, got, c.want)
+		}
+	}
+}
+
+func TestUndo(t *testing.T) {
+	check_edits(t, []edit_case{
+		{"abc\n", "xxu", "bc\n"},
+		{"abc\n", "xxuu", "abc\n"},
+		{"abc\n", "xxuu\x12", "bc\n"},  // ctrl-R redoes
+		{"abc\n", "ixy\x1bu", "abc\n"}, // an insert is one step
+		{"a\nb\n", "ddpu", "b\n"},
+		{"abc\n", "xu\x12\x12", "bc\n"},     // nothing more to redo
+		{"abc\n", "xxuix\x1b\x12", "xbc\n"}, // an edit drops the redo
+	})
+}
+
+func TestOperators(t *testing.T) {
+	check_edits(t, []edit_case{
+		{"one two three\n", "dw", "two three\n"},
+		{"one two three\n", "d2w", "three\n"},
+		{"one two three\n", "2dw", "three\n"},
+		{"one two three\n", "cwX\x1b", "X two three\n"},
+		{"one two three\n", "wd$", "one \n"},
+		{"a\nb\nc\n", "dj", "c\n"},
+		{"a\nb\nc\n", "2dd", "c\n"},
+		{"a\nb\nc\n", "yjGp", "a\nb\nc\na\nb\n"},
+		{"a\nb\n", ">j", "\ta\n\tb\n"},
+		{"\ta\n", "<<", "a\n"},
+		{"a.b c\n", "dW", "c\n"},
+	})
+}
+
+func TestRegisters(t *testing.T) {
+	check_edits(t, []edit_case{
+		{"a\nb\n", "\"ayyj\"ap", "a\nb\na\n"},
+		{"a\nb\n", "\"ayyj\"Ayy\"ap", "a\nb\na\nb\n"}, // "A appends
+		{"a\nb\n", "\"ayyjdd\"ap", "a\na\n"},
+		{"a\nb\n", "yyjddk\"0p", "a\na\n"}, // "0 keeps the yank
+		{"abc\n", "xp", "bac\n"},
+		{"abc\n", "xP", "abc\n"},
+		{"a\nb\n", "\"ayy:2put a\r", "a\nb\na\n"},
+	})
+}
+
+func TestMotions(t *testing.T) {
+	line := "one two, three\n"
+	check_edits(t, []edit_case{
+		{line, "wx", "one wo, three\n"},
+		{line, "2wx", "one two three\n"},
+		{line, "WWx", "one two, hree\n"},
+		{line, "ex", "on two, three\n"},
+		{line, "$bx", "one two, hree\n"},
+		{line, "fex", "on two, three\n"},
+		{line, "tex", "oe two, three\n"},
+		{line, "f,x", "one two three\n"},
+		{line, "fe;x", "one two, thre\n"},
+		{line, "$Fox", "one tw, three\n"},
+		{line, "$x0x", "ne two, thre\n"},
+		{"  ab\n", "$^x", "  b\n"},
+		{"a\n\nb\nc\n", "}dd", "a\nb\nc\n"},
+		{"a\nb\nc\n", "Gx", "a\nb\n\n"},
+		{"a\nb\nc\n", "2Gx", "a\n\nc\n"},
+		{"A b. C d.\n", "$(x", "A b.  d.\n"},
+	})
+}
+
+func TestInsertKeys(t *testing.T) {
+	check_edits(t, []edit_case{
+		{"\n", "iabc\x7f\x1b", "ab\n"},
+		{"\n", "ione two\x17\x1b", "one \n"},  // ctrl-W
+		{"\n", "ione two\x15\x1b", "\n"},      // ctrl-U
+		{"\n", "i\x16\x01\x1b", "\x01\n"},     // ctrl-V
+		{"\n", "ia\x14\x1b", "\ta\n"},         // ctrl-T
+		{"\ta\n", "A\x04\x1b", "a\n"},         // ctrl-D
+		{"ab\n", "ywo\x12\"\x1b", "ab\nab\n"}, // ctrl-R
+		{"ab\n", "\"ayyo\x12a\x1b", "ab\nab\n\n"},
+	})
+}
+
+func TestMacros(t *testing.T) {
+	check_edits(t, []edit_case{
+		{"a\nb\nc\n", "qqA!\x1bjq@q", "a!\nb!\nc\n"},
+		{"a\nb\nc\nd\n", "qqA!\x1bjq2@q", "a!\nb!\nc!\nd\n"},
+		{"a\nb\nc\nd\n", "qqA!\x1bjq@q@@", "a!\nb!\nc!\nd\n"},
+		{"a\nb\nc\n", "qqxjq:2,3norm @q\r", "\n\n\n"},
+		{"ab\nab\n", "qqxqqQjq@q", "b\nb\n"}, // qQ appends
+		{"a\nb\nc\n", "qqddq5@q", ""},        // stops when dd fails
+	})
+}
+
+func TestMarks(t *testing.T) {
+	check_edits(t, []edit_case{
+		{"a\nb\nc\n", "majj'ax", "\nb\nc\n"},
+		{"abc\nd\n", "lmaj`ax", "ac\nd\n"},
+		{"a\nb\nc\n", "jmakdd'ax", "\nc\n"}, // follows the edit
+		{"a\nb\nc\n", "jmaggd'a", "c\n"},
+		{"a\nb\nc\n", "Gggx''x", "\nb\n\n"},
+		{"a\nb\nc\n", "G\x0fx", "\nb\nc\n"}, // ctrl-O
+	})
+}
+
+func TestGlobal(t *testing.T) {
+	check_edits(t, []edit_case{
+		{"a1\nb\na2\n", ":g/a/d\r", "b\n"},
+		{"a1\nb\na2\n", ":v/a/d\r", "a1\na2\n"},
+		{"a1\nb\na2\na3\n", ":g/a/m0\r", "a3\na2\na1\nb\n"},
+		{"a\nb\n", ":g/^/t.\r", "a\na\nb\nb\n"},
+		{"a1\na2\na3\nb\n", ":g/a/j\r", "a1 a2\na3 b\n"},
+		{"a1\nb\na2\n", ":g/a/s/a/x/\r", "x1\nb\nx2\n"},
+		{"a1\nb\na2\n", ":g/a/d\ru", "a1\nb\na2\n"}, // one undo step
+	})
+	g, _ := new_test_editor(t, strings.Repeat("debug\nkeep\n", 20000))
+	type_keys(g, ":g/debug/d\r")
+	if n := g.line_count(); n != 20000 {
+		t.Fatalf("%d lines left, want 20000", n)
+	}
+}
+
+func TestNormal(t *testing.T) {
+	check_edits(t, []edit_case{
+		{"a\nb\nc\nd\n", ":%norm dd\r", ""},
+		{"a\nb\nc\n", ":%norm yyp\r", "a\na\nb\nb\nc\nc\n"},
+		{"a\nb\nc\n", ":2,3norm A!\r", "a\nb!\nc!\n"},
+		{"a\nb\nc\n", ":%norm ix\r", "xa\nxb\nxc\n"},
+		{"a\nb\nc\n", ":%norm jdd\r", "a\n"},
+		{"ab\nb\nab\n", ":g/a/norm x\r", "b\nb\nb\n"},
+	})
+}
+
+func TestDot(t *testing.T) {
+	words := "a b c d e f g h i\n"
+	check_edits(t, []edit_case{
+		{words, "dw.", "c d e f g h i\n"},
+		{words, "d3w.", "g h i\n"},
+		{words, "d3w2.", "f g h i\n"}, // the new count replaces 3
+		{words, "2d2w.", "i\n"},
+		{words, "d3w2..", "h i\n"}, // and is kept
+		{words, "3x.", "d e f g h i\n"},
+		{"a\nb\n", "Ax\x1bj.", "ax\nbx\n"},
+		{"a\nb\nc\n", "dd.", "c\n"},
+		{"abc\n", "rx.", "xbc\n"},
+	})
+}
+
+func TestBuffers(t *testing.T) {
+	f2 := filepath.Join(t.TempDir(), "f2")
+	check_edits(t, []edit_case{
+		{"abc\n", ":e " + f2 + "\r:b1\rxx:b! 2\r:b1\r", "c\n"}, // kept hidden
+		{"abc\n", ":e " + f2 + "\r:b1\rxx:bn!\r:bn\r", "c\n"},
+		{"abc\n", ":e " + f2 + "\r:b1\rxx:e! " + f2 + "\r:b1\r", "abc\n"}, // thrown away
+		{"abc\n", "xx:new\r:b1\r", "c\n"},
+		{"abc\n", ":new\rihi\x1b:clo!\r:b2\r", "hi\n"},
+		{"abc\n", ":new\rihi\x1b:q!\r:b2\r", "\n"},
+		{"abc\n", "xx:e " + f2 + "\r", "c\n"}, // not without !
+		{"abc\n", ":set hidden\rxx:e " + f2 + "\r:e #\r", "c\n"},
+	})
+}
+
+func TestWideChars(t *testing.T) {
+	g, vt := new_test_editor(t, "中文x\n")
+	type_keys(g, "ll")
+	check_lines(t, vt, 0, "1 中文x")
+	if r, c := vt.cursor(); r != 0 || c != 6 {
+		t.Fatalf("cursor at %d,%d, want 0,6", r, c)
+	}
+}
+
+func TestCombiningMarks(t *testing.T) {
+	g, vt := new_test_editor(t, "e\u0301t\u4e2d\u0301\n\u0301x\n")
+	type_keys(g, "j")
+	check_lines(t, vt, 0, "1 e\u0301t\u4e2d\u0301", "2  \u0301x")
+}
+
+func TestSplitAndTabs(t *testing.T) {
+	g, vt := new_test_editor(t, "one\n")
+	type_keys(g, ":sp\r")
+	check_lines(t, vt, 0, "1 one", "~", "~", "~")
+	if vt.cell(4, 0) != ' '|SCR_INVERSE || vt.cell(5, 0) != '1' {
+		t.Fatalf("no status line between the windows: %q %q", vt.line(4), vt.line(5))
+	}
+	type_keys(g, ":tabnew\r")
+	check_lines(t, vt, 0, " 1 file.txt  2 [No Name]", "1", "~")
+	type_keys(g, "gt")
+	if g.tab_index(g.tab) != 0 || len(g.windows()) != 2 {
+		t.Fatalf("tab %d with %d windows", g.tab_index(g.tab), len(g.windows()))
+	}
+	check_lines(t, vt, 1, "1 one")
+}
+
+func TestResize(t *testing.T) {
+	g, vt := new_test_editor(t, "one\ntwo\n")
+	vt.resize(6, 20)
+	type_keys(g, "j")
+	if g.rows != 6 || g.columns != 20 {
+		t.Fatalf("screen %dx%d, want 6x20", g.rows, g.columns)
+	}
+	check_lines(t, vt, 0, "1 one", "2 two", "~", "~", "~")
+	if r, c := vt.cursor(); r != 1 || c != 2 {
+		t.Fatalf("cursor at %d,%d, want 1,2", r, c)
+	}
+}
+
+// windows that no longer fit are closed, the current one stays
+func TestResizeWithSplits(t *testing.T) {
+	g, vt := new_test_editor(t, "one\n")
+	type_keys(g, ":sp\r:sp\r:vsp\r")
+	if n := len(g.windows()); n != 4 {
+		t.Fatalf("%d windows, want 4", n)
+	}
+	cur := g.win
+	vt.resize(6, 20) // room for two rows of windows
+	type_keys(g, "l")
+	if n := len(g.windows()); n != 3 || g.win != cur {
+		t.Fatalf("%d windows, want 3 with the current one", n)
+	}
+	vt.resize(4, 20) // the two side by side
+	type_keys(g, "l")
+	if n := len(g.windows()); n != 2 || g.win != cur {
+		t.Fatalf("%d windows, want 2", n)
+	}
+	vt.resize(2, 20)
+	type_keys(g, "l")
+	if n := len(g.windows()); n != 1 || g.win != cur {
+		t.Fatalf("%d windows, want 1", n)
+	}
+	check_lines(t, vt, 0, "1 one")
+	vt.resize(8, 2) // too narrow for the '|'
+	type_keys(g, ":vsp\r:tabnew\r:sp\rgt")
+	vt.resize(3, 1)
+	type_keys(g, "gt")
+	vt.resize(10, 40)
+	type_keys(g, "gt")
+	check_lines(t, vt, 1, "1 one")
+}
+
+// a prompt is drawn again after a resize
+func TestResizeInPrompt(t *testing.T) {
+	g, vt := new_test_editor(t, "one\n")
+	go func() {
+		g.events <- event{kind: EVENT_INPUT, input: []byte(":ab")}
+		vt.resize(6, 20)
+		g.events <- event{kind: EVENT_INPUT, input: []byte("c\x1b")}
+	}()
+	g.edit_step()
+	g.out_flush()
+	check_lines(t, vt, 0, "1 one", "~", "~", "~", "~", ":abc")
+}
+
+// resizes from another goroutine while typing, for go test -race
+func TestResizeWhileTyping(t *testing.T) {
+	g, vt := new_test_editor(t, "")
+	done := make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				vt.resize(8+i%4, 30+i%10)
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		type_keys(g, "oline\x1b0") // 0: no wait for more of an escape sequence
+	}
+	close(done)
+	if n := g.line_count(); n != 101 {
+		t.Fatalf("%d lines, want 101", n)
+	}
+}
+
+func TestArgList(t *testing.T) {
+	g, _ := new_test_editor(t, "one\n")
+	dir := t.TempDir()
+	type_keys(g, ":args "+dir+"/a "+dir+"/b "+dir+"/c\r:2n\r")
+	if g.arg_idx != 2 {
+		t.Fatalf("file %d, want 2", g.arg_idx)
+	}
+	type_keys(g, ":N 2\r:x\r")
+	if g.arg_idx != 0 || g.editing == 0 {
+		t.Fatalf("file %d, editing %d", g.arg_idx, g.editing)
+	}
+	type_keys(g, ":x\r") // the second one quits
+	if g.editing != 0 {
+		t.Fatal("still editing")
+	}
+}
+
+func TestOneWritePerFrame(t *testing.T) {
+	g, vt := new_test_editor(t, "one\n")
+	n := vt.writes
+	type_keys(g, "ohello\x1bdd")
+	if vt.writes != n+1 {
+		t.Fatalf("%d writes, want 1", vt.writes-n)
+	}
+	if vt.hidden {
+		t.Fatal("cursor left hidden")
+	}
+}
+
+// the whole editor: keys read from the terminal until :wq
+func TestEditFile(t *testing.T) {
+	log.SetOutput(io.Discard)
+	fn := filepath.Join(t.TempDir(), "file.txt")
+	os.WriteFile(fn, []byte("one\n"), 0644)
+	vt := new_virtual_terminal(10, 40)
+	var g globals
+	g.init(vt)
+	vt.feed("xxxit")
+	vt.feed("wo\x1b:wq\r")
+	g.edit_file(fn)
+	if b, _ := os.ReadFile(fn); string(b) != "two\n" {
+		t.Fatalf("file holds %q", b)
+	}
+	g.out_flush() // the last frame, main sends it
+	check_lines(t, vt, 0, "1 two")
+}
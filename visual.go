@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+)
+
+//----- Visual mode: v V ctrl-V ----------------------------------
+// The selection runs from visual_start to dot. v selects chars,
+// V whole lines and ctrl-V a block of screen columns. Motions move
+// dot, an operator works on the selection and ends visual mode.
+const VISUAL_BLOCK = 22 // ctrl-V
+
+// block I and A, waiting for insert mode to end
+type block_insert struct {
+	lines int // lines in the block
+	col   int // screen column the text goes to
+	start int // where it was typed on the first line
+	eol   bool
+	pad   bool // A pads short lines with spaces
+}
+
+// the selection as shown by format_line, updated by refresh
+type visual_sel struct {
+	lo, hi int // first and last char (v), first and last line start (V, block)
+	c1, c2 int // screen columns of a block, c2 inclusive
+	end    int // the last selected char, the end of line hi (V, block)
+}
+
+func visual_name(mode int) string {
+	switch mode {
+	case 'V':
+		return "-- VISUAL LINE --"
+	case VISUAL_BLOCK:
+		return "-- VISUAL BLOCK --"
+	}
+	return "-- VISUAL --"
+}
+
+func (g *globals) visual_begin(mode int) {
+	if g.visual_mode == 0 {
+		g.visual_start = g.dot
+		g.visual_eol = false
+	}
+	g.visual_mode = mode
+	g.status_line_bold("%s", visual_name(mode))
+}
+
+// leave visual mode, remembering the selection for gv and '< '>
+func (g *globals) visual_end() {
+	if g.visual_mode == 0 {
+		return
+	}
+	g.visual_last_mode, g.visual_last_start, g.visual_last_end = g.visual_mode, g.visual_start, g.dot
+	g.visual_mode = 0
+	g.go_bottom_and_clear_to_eol() // the -- VISUAL -- message
+}
+
+// gv: select the last selection again
+func (g *globals) visual_again() {
+	if g.visual_last_mode == 0 || g.text.size() == 0 {
+		return
+	}
+	last := g.text.size() - 1
+	g.visual_begin(g.visual_last_mode)
+	g.visual_start = TernaryInt(g.visual_last_start > last, last, g.visual_last_start)
+	g.dot = TernaryInt(g.visual_last_end > last, last, g.visual_last_end)
+}
+
+// the block columns covered by the chars at p and q
+func (g *globals) block_cols(p, q int) (int, int) {
+	pc, qc := g.col_of(p), g.col_of(q)
+	pr, _ := g.text.rune_at(p)
+	qr, _ := g.text.rune_at(q)
+	pe, qe := g.col_after(pr, pc)-1, g.col_after(qr, qc)-1
+	if pc > qc {
+		pc, qc = qc, pc
+	}
+	if pe < qe {
+		pe = qe
+	}
+	return pc, TernaryInt(pe < pc, pc, pe)
+}
+
+// work out g.vsel from visual_start and dot
+func (g *globals) visual_bounds() {
+	if g.visual_mode == 0 {
+		return
+	}
+	lo, hi := g.visual_start, g.dot
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	g.vsel.lo, g.vsel.hi, g.vsel.end = lo, hi, hi
+	if g.visual_mode != 'v' {
+		g.vsel.lo, g.vsel.hi = g.begin_line(lo), g.begin_line(hi)
+		g.vsel.end = g.end_line(hi)
+	}
+	if g.visual_mode == VISUAL_BLOCK {
+		g.vsel.c1, g.vsel.c2 = g.block_cols(g.visual_start, g.dot)
+		if g.visual_eol {
+			g.vsel.c2 = MAX_SCR_COLS * MAX_TABSTOP
+		}
+	}
+}
+
+// is the char at p, shown in columns c0 to c1 (exclusive), selected
+func (g *globals) visual_has(p int, c0, c1 int) bool {
+	if p < g.vsel.lo || p > g.vsel.end {
+		return false
+	}
+	return g.visual_mode != VISUAL_BLOCK || c0 <= g.vsel.c2 && c1 > g.vsel.c1
+}
+
+// the part of the line at l inside the block
+func (g *globals) block_span(l int) (int, int) {
+	p := g.move_to_col(l, g.vsel.c1)
+	if g.visual_eol {
+		return p, g.end_line(l)
+	}
+	q := g.move_to_col(l, g.vsel.c2)
+	if q < g.text.size() && g.text.at(q) != '\n' {
+		q = g.next_rune(q)
+	}
+	return p, q
+}
+
+// the selection as one text range per line of the block, or as a
+// single range for v and V. The ranges are in reverse order so
+// they stay valid while changing the text from the first to the last.
+func (g *globals) visual_ranges() [][2]int {
+	var r [][2]int
+	switch g.visual_mode {
+	case 'v':
+		r = append(r, [2]int{g.vsel.lo, g.next_rune(g.vsel.hi)})
+	case 'V':
+		r = append(r, [2]int{g.vsel.lo, g.end_line(g.vsel.hi)})
+	default:
+		for l := g.vsel.hi; ; l = g.prev_line(l) {
+			p, q := g.block_span(l)
+			r = append(r, [2]int{p, q})
+			if l <= g.vsel.lo {
+				break
+			}
+		}
+	}
+	return r
+}
+
+// do_visual runs key c in visual mode. It returns false for keys
+// do_cmd should handle as in command mode: counts, "x and scrolling.
+func (g *globals) do_visual(c int) bool {
+	switch c {
+	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '"',
+		2, 4, 5, 6, KEYCODE_PAGEUP, KEYCODE_PAGEDOWN:
+		return false
+	case 27:
+		g.visual_end()
+		return true
+	case 'v', 'V', VISUAL_BLOCK:
+		if c == g.visual_mode {
+			g.visual_end()
+		} else {
+			g.visual_begin(c)
+		}
+		return true
+	case 'o': // to the other end of the selection
+		g.dot, g.visual_start = g.visual_start, g.dot
+		return true
+	case '$': // a block then goes to the end of each line
+		g.visual_eol = g.visual_mode == VISUAL_BLOCK
+		g.do_motion(c)
+		return true
+	}
+	if g.visual_op(c) {
+		return true
+	}
+	kind := g.do_motion(c)
+	if kind != MOTION_NONE && c != 'j' && c != 'k' &&
+		c != KEYCODE_UP && c != KEYCODE_DOWN {
+		g.visual_eol = false
+	}
+	g.key_failed = kind == MOTION_FAILED
+	return true
+}
+
+// visual_op applies an operator to the selection and leaves visual mode.
+// It returns false if c is no operator.
+func (g *globals) visual_op(c int) bool {
+	g.visual_bounds()
+	mode := g.visual_mode
+	start, end := g.visual_start, g.dot // for gv
+	lines := g.count_lines(g.vsel.lo, g.vsel.hi) + 1
+	switch c {
+	case 'x', 'X', 'D', 'Y', 's', 'S', 'C', 'R':
+		// X D Y S C R work on whole lines, D and C in a block to the line ends
+		if mode == VISUAL_BLOCK && (c == 'D' || c == 'C') {
+			g.visual_eol = true
+			g.visual_bounds()
+		} else if c != 'x' && c != 's' {
+			mode = 'V'
+		}
+		c = TernaryInt(c == 'Y', 'y', TernaryInt(strings.IndexByte("sSCR", byte(c)) >= 0, 'c', 'd'))
+		fallthrough
+	case 'd', 'c', 'y':
+		g.visual_mode = mode
+		if mode == VISUAL_BLOCK {
+			g.block_op(c)
+		} else if mode == 'V' {
+			g.op_apply(c, g.vsel.lo, g.vsel.hi, MOTION_LINEWISE)
+		} else {
+			g.op_apply(c, g.vsel.lo, g.vsel.hi, MOTION_INCLUSIVE)
+		}
+		if c == 'y' && mode != VISUAL_BLOCK {
+			g.dot = g.vsel.lo
+		}
+	case '>', '<':
+		g.op_apply(c, g.vsel.lo, g.vsel.hi, MOTION_LINEWISE)
+	case '~', 'u', 'U', 'r':
+		with := 0
+		if c == 'r' {
+			if with = g.get_one_char(); with < ' ' && with != '\t' {
+				break // ESC, or a char that would break lines
+			}
+		}
+		ranges := g.visual_ranges()
+		for _, r := range ranges {
+			g.change_chars(r[0], r[1], c, rune(with))
+		}
+		g.dot = ranges[len(ranges)-1][0]
+	case 'J', KEY_G - 'J':
+		g.join_lines(g.vsel.lo, TernaryInt(lines < 2, 2, lines), c == 'J')
+	case ':':
+		g.visual_end()
+		g.colon(g.get_input_line(":'<,'>"))
+		return true
+	case 'I', 'A':
+		if mode != VISUAL_BLOCK {
+			if c == 'I' {
+				g.dot = TernaryInt(mode == 'V', g.first_nonblank(g.vsel.lo), g.vsel.lo)
+			} else {
+				g.dot = TernaryInt(mode == 'V', g.end_line(g.vsel.hi), g.next_rune(g.vsel.hi))
+			}
+			g.visual_end()
+			g.cmd_mode = 1
+			return true
+		}
+		g.block_insert_start(c, g.vsel.lo, lines)
+	default:
+		return false
+	}
+	g.visual_end()
+	g.visual_last_mode, g.visual_last_start, g.visual_last_end = mode, start, end
+	return true
+}
+
+// d c y on a block
+func (g *globals) block_op(op int) {
+	ranges := g.visual_ranges()
+	var text [][]byte
+	for i := len(ranges) - 1; i >= 0; i-- {
+		text = append(text, g.text.copy_out(ranges[i][0], ranges[i][1]))
+	}
+	g.reg_store_block(op, text)
+	if op != 'y' {
+		for _, r := range ranges {
+			g.string_delete(r[0], r[1])
+		}
+	}
+	g.dot = ranges[len(ranges)-1][0]
+	if op == 'c' {
+		g.block_insert_start('I', g.vsel.lo, len(ranges))
+	}
+}
+
+// ~ u U change the case of the letters in text[p:q], r replaces
+// each char with with. The '\n's stay.
+func (g *globals) change_chars(p, q int, op int, with rune) {
+	var b bytes.Buffer
+	for s := p; s < q; {
+		c, size := g.text.rune_at(s)
+		switch {
+		case c == '\n':
+		case op == 'r':
+			c = with
+		case op == 'u':
+			c = unicode.ToLower(c)
+		case op == 'U':
+			c = unicode.ToUpper(c)
+		case unicode.IsLower(c):
+			c = unicode.ToUpper(c)
+		default:
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+		s += size
+	}
+	if !bytes.Equal(b.Bytes(), g.text.copy_out(p, q)) {
+		g.string_delete(p, q)
+		g.string_insert(p, b.Bytes())
+	}
+}
+
+// I and A in block mode insert on the first line of the block.
+// When insert mode ends the text typed is put on the other lines.
+func (g *globals) block_insert_start(c int, l int, lines int) {
+	col := g.vsel.c1
+	if c == 'A' {
+		col = g.vsel.c2 + 1
+	}
+	g.dot = g.move_to_col(l, col)
+	if c == 'A' && g.visual_eol {
+		g.dot = g.end_line(l)
+	} else if g.col_of(g.dot) < col { // A past a short line
+		n := col - g.col_of(g.dot)
+		g.dot = g.string_insert(g.dot, []byte(strings.Repeat(" ", n)))
+	}
+	g.block_ins = block_insert{lines: lines, col: col, start: g.dot, eol: c == 'A' && g.visual_eol, pad: c == 'A'}
+	g.cmd_mode = 1
+}
+
+// copy the text inserted from block_ins.start to p to the other lines
+func (g *globals) block_insert_done(p int) {
+	bi := g.block_ins
+	g.block_ins = block_insert{}
+	if p <= bi.start || g.text.index_byte(bi.start, p, '\n') >= 0 {
+		return // nothing typed, or more than one line
+	}
+	text := g.text.copy_out(bi.start, p)
+	l := g.begin_line(bi.start)
+	for i := 1; i < bi.lines; i++ {
+		if l = g.next_line(l); l >= g.text.size() {
+			break
+		}
+		q := g.move_to_col(l, bi.col)
+		if bi.eol {
+			q = g.end_line(l)
+		} else if co := g.col_of(q); co < bi.col {
+			if !bi.pad {
+				continue // I skips lines too short for the block
+			}
+			q = g.string_insert(q, []byte(strings.Repeat(" ", bi.col-co)))
+		}
+		g.string_insert(q, text)
+	}
+}
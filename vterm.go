@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+//----- A terminal in memory, for tests ----------------------------
+// It keeps a grid of cells like g.screen, inverse cells with
+// SCR_INVERSE set, and understands the escape sequences the editor
+// sends. Keys given to feed are what read returns.
+type virtual_terminal struct {
+	mu         sync.Mutex
+	rows, cols int
+	cells      []rune
+	marks      map[int]string // combining marks on a cell
+	row, col   int            // the cursor
+	inverse    bool
+	hidden     bool // the cursor, ESC [ ? 25 l
+	writes     int  // number of writes, one per frame
+	keys       chan []byte
+	rest       []byte // of a feed that did not fit into a read
+	resized    func()
+}
+
+func new_virtual_terminal(rows, cols int) *virtual_terminal {
+	t := &virtual_terminal{keys: make(chan []byte, 64)}
+	t.set_size(rows, cols)
+	return t
+}
+
+func (t *virtual_terminal) set_size(rows, cols int) {
+	t.rows, t.cols = rows, cols
+	t.cells = make([]rune, rows*cols)
+	t.marks = map[int]string{}
+	for i := range t.cells {
+		t.cells[i] = ' '
+	}
+	t.row, t.col = 0, 0
+}
+
+// type keys on the terminal
+func (t *virtual_terminal) feed(keys string) {
+	t.keys <- []byte(keys)
+}
+
+// no more keys: read fails once the ones fed are read
+func (t *virtual_terminal) close() {
+	close(t.keys)
+}
+
+// change the size as a window system would, the screen is cleared
+func (t *virtual_terminal) resize(rows, cols int) {
+	t.mu.Lock()
+	t.set_size(rows, cols)
+	fn := t.resized
+	t.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// the text of screen row r, without trailing blanks
+func (t *virtual_terminal) line(r int) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var b strings.Builder
+	for i, c := range t.cells[r*t.cols : (r+1)*t.cols] {
+		if c &^= SCR_INVERSE; c != SCR_WIDE_PAD {
+			b.WriteRune(c)
+		}
+		b.WriteString(t.marks[r*t.cols+i])
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// the cell at r, c, with SCR_INVERSE if it is shown inverse
+func (t *virtual_terminal) cell(r, c int) rune {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cells[r*t.cols+c]
+}
+
+func (t *virtual_terminal) cursor() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.row, t.col
+}
+
+//----- The terminal interface -----------------------------------
+
+func (t *virtual_terminal) size() (int, int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rows, t.cols, true
+}
+
+func (t *virtual_terminal) read(buf []byte) (int, error) {
+	if len(t.rest) == 0 {
+		b, ok := <-t.keys
+		if !ok {
+			return 0, io.EOF
+		}
+		t.rest = b
+	}
+	n := copy(buf, t.rest)
+	t.rest = t.rest[n:]
+	return n, nil
+}
+
+func (t *virtual_terminal) raw_mode() int {
+	return 0x7f
+}
+
+func (t *virtual_terminal) cooked_mode() {}
+
+func (t *virtual_terminal) on_resize(fn func()) {
+	t.mu.Lock()
+	t.resized = fn
+	t.mu.Unlock()
+}
+
+func (t *virtual_terminal) write(b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writes++
+	for len(b) > 0 {
+		if b[0] == 27 && len(b) > 1 && b[1] == '[' {
+			b = t.escape(b[2:])
+			continue
+		}
+		c, size := utf8.DecodeRune(b)
+		b = b[size:]
+		switch c {
+		case '\b':
+			t.col = TernaryInt(t.col > 0, t.col-1, 0)
+		case '\r':
+			t.col = 0
+		case '\n':
+			t.row = TernaryInt(t.row < t.rows-1, t.row+1, t.row)
+		default:
+			t.put(c)
+		}
+	}
+}
+
+// a char at the cursor, a wide one takes two cells and a combining
+// mark goes on the cell before
+func (t *virtual_terminal) put(c rune) {
+	w := RuneWidth(c)
+	p := t.row*t.cols + t.col
+	if c >= ' ' && w == 0 && t.col > 0 {
+		p -= TernaryInt(t.col > 1 && t.cells[p-1]&^SCR_INVERSE == SCR_WIDE_PAD, 2, 1)
+		t.marks[p] += string(c)
+		return
+	}
+	if c < ' ' || w == 0 || t.col+w > t.cols {
+		return
+	}
+	delete(t.marks, p)
+	t.cells[p] = TernaryRune(t.inverse, c|SCR_INVERSE, c)
+	if w == 2 {
+		t.cells[p+1] = TernaryRune(t.inverse, SCR_WIDE_PAD|SCR_INVERSE, SCR_WIDE_PAD)
+	}
+	t.col += w
+	t.col = TernaryInt(t.col >= t.cols, t.cols-1, t.col)
+}
+
+// run the sequence after ESC [ at the start of b, returning the rest
+func (t *virtual_terminal) escape(b []byte) []byte {
+	private := len(b) > 0 && b[0] == '?'
+	if private {
+		b = b[1:]
+	}
+	var params []int
+	num := -1
+	for len(b) > 0 {
+		c := b[0]
+		b = b[1:]
+		switch {
+		case c >= '0' && c <= '9':
+			num = TernaryInt(num < 0, 0, num)*10 + int(c-'0')
+			continue
+		case c == ';':
+			params = append(params, num)
+			num = -1
+			continue
+		case c == '$': // ESC [ ? 2026 $ p
+			continue
+		}
+		params = append(params, num)
+		t.command(c, private, params)
+		break
+	}
+	return b
+}
+
+func (t *virtual_terminal) command(c byte, private bool, params []int) {
+	arg := func(i, def int) int {
+		if i < len(params) && params[i] > 0 {
+			return params[i]
+		}
+		return def
+	}
+	switch {
+	case private && (c == 'h' || c == 'l'):
+		if params[0] == 25 {
+			t.hidden = c == 'l'
+		}
+	case c == 'H':
+		t.row = TernaryInt(arg(0, 1) > t.rows, t.rows, arg(0, 1)) - 1
+		t.col = TernaryInt(arg(1, 1) > t.cols, t.cols, arg(1, 1)) - 1
+	case c == 'K':
+		t.clear(t.row*t.cols+t.col, (t.row+1)*t.cols)
+	case c == 'J':
+		t.clear(t.row*t.cols+t.col, len(t.cells))
+	case c == 'm':
+		t.inverse = arg(0, 0) == 7
+	}
+}
+
+func (t *virtual_terminal) clear(from, to int) {
+	for i := from; i < to; i++ {
+		t.cells[i] = ' '
+		delete(t.marks, i)
+	}
+}
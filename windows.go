@@ -0,0 +1,496 @@
+package main
+
+import "fmt"
+
+//----- Windows: :split :vsplit ctrl-W ---------------------------
+// A window shows a buffer in a rectangle of the screen, with a status
+// line below it once there is more than one. The windows are the
+// leaves of a tree of frames: a frame holds one window, or frames one
+// above the other (:split) or side by side (:vsplit, with a column of
+// '|' between them). The current window's cursor and scroll position
+// are g.dot and g.screenbegin of its buffer, the others keep theirs.
+type window struct {
+	buf         *buffer
+	dot         int // while it is not the current window
+	screenbegin int
+
+	top, left     int // screen position of the text
+	height, width int // rows and columns of text
+	status        bool
+	frame         *frame
+}
+
+type frame struct {
+	win      *window // a window, or
+	vertical bool    // kids side by side, else one above the other
+	kids     []*frame
+	parent   *frame
+	size     int // rows (columns when side by side) it has in its parent
+}
+
+// call fn for each window of f, top left first
+func (f *frame) each(fn func(w *window)) {
+	if f.win != nil {
+		fn(f.win)
+	}
+	for _, k := range f.kids {
+		k.each(fn)
+	}
+}
+
+// the windows in screen order
+func (g *globals) windows() []*window {
+	var ws []*window
+	g.frame_root.each(func(w *window) { ws = append(ws, w) })
+	return ws
+}
+
+// one tab page with one window on the whole screen, showing the
+// current buffer
+func (g *globals) win_init() {
+	g.win = &window{buf: g.buffer}
+	g.frame_root = &frame{win: g.win}
+	g.win.frame = g.frame_root
+	g.tab = &tab_page{}
+	g.tabs = []*tab_page{g.tab}
+	g.win_layout()
+}
+
+// make w the current window
+func (g *globals) win_enter(w *window) {
+	if w == g.win {
+		return
+	}
+	g.win.dot, g.win.screenbegin = g.dot, g.screenbegin
+	g.win = w
+	g.buffer = w.buf
+	g.dot, g.screenbegin = w.dot, w.screenbegin
+	if size := g.text.size(); g.dot >= size {
+		g.dot = TernaryInt(size > 0, size-1, 0)
+	}
+}
+
+// the number of windows showing buffer b, on any tab page
+func (g *globals) buffer_windows(b *buffer) int {
+	n := 0
+	g.each_window(func(w *window) {
+		if w.buf == b {
+			n++
+		}
+	})
+	return n
+}
+
+// window positions on the buffer move with its text like marks do
+func (g *globals) win_shift(shift func(m *int)) {
+	g.each_window(func(w *window) {
+		if w != g.win && w.buf == g.buffer {
+			shift(&w.dot)
+			shift(&w.screenbegin)
+		}
+	})
+}
+
+//----- Layout ---------------------------------------------------
+
+// give each window its rectangle: all rows but the tab line and
+// the last, where the command line stays. Windows that do not fit
+// any more are closed, the last ones first.
+func (g *globals) win_layout() {
+	g.win_seps = g.win_seps[:0]
+	top := g.tab_line_rows()
+	rows, cols := g.rows-1-top, g.columns
+	for g.frame_root.win == nil && (g.frame_root.min_size(false) > rows || g.frame_root.min_size(true) > cols) {
+		ws := g.windows()
+		w := ws[len(ws)-1]
+		if w == g.win {
+			w = ws[len(ws)-2]
+		}
+		g.win_remove(w)
+	}
+	g.frame_layout(g.frame_root, top, 0, rows, cols)
+}
+
+// the fewest rows (columns if cols) frame f can be shown in: a row
+// of text and the status line for each window
+func (f *frame) min_size(cols bool) int {
+	if f.win != nil {
+		return TernaryInt(cols || f.parent == nil, 1, 2)
+	}
+	n := 0
+	for _, k := range f.kids {
+		m := k.min_size(cols)
+		if f.vertical == cols {
+			n += m
+		} else if m > n {
+			n = m
+		}
+	}
+	if f.vertical && cols {
+		n += len(f.kids) - 1 // the '|' columns
+	}
+	return n
+}
+
+func (g *globals) frame_layout(f *frame, top, left, height, width int) {
+	if w := f.win; w != nil {
+		w.top, w.left, w.width = top, left, width
+		w.status = f != g.frame_root
+		w.height = height - TernaryInt(w.status, 1, 0)
+		w.height = TernaryInt(w.height < 1, 1, w.height)
+		return
+	}
+	n := len(f.kids)
+	if f.vertical {
+		frame_fit(f.kids, width-(n-1), true)
+	} else {
+		frame_fit(f.kids, height, false)
+	}
+	for i, k := range f.kids {
+		if f.vertical {
+			g.frame_layout(k, top, left, height, k.size)
+			left += k.size
+			if i < n-1 {
+				g.win_seps = append(g.win_seps, [3]int{top, left, height})
+				left++
+			}
+		} else {
+			g.frame_layout(k, top, left, k.size, width)
+			top += k.size
+		}
+	}
+}
+
+// share total rows or columns (cols) among frames, keeping their
+// sizes in proportion. Sizes below a frame's min_size (0 after
+// ctrl-W =) share it evenly. Each frame gets at least its min_size
+// while that fits.
+func frame_fit(kids []*frame, total int, cols bool) {
+	n := len(kids)
+	sum, need := 0, 0
+	even := false
+	for _, k := range kids {
+		min := k.min_size(cols)
+		even = even || k.size < min
+		sum += k.size
+		need += min
+	}
+	if sum == total && !even {
+		return
+	}
+	rest := total
+	for i, k := range kids {
+		min := k.min_size(cols)
+		need -= min // what the ones after k need
+		switch {
+		case i == n-1:
+			k.size = rest
+		case even:
+			k.size = total/n + TernaryInt(i < total%n, 1, 0)
+		default:
+			k.size = k.size * total / sum
+		}
+		k.size = TernaryInt(k.size > rest-need, rest-need, k.size)
+		k.size = TernaryInt(k.size < min, min, k.size)
+		rest -= k.size
+	}
+}
+
+// put frame nf in place of f in the tree
+func (g *globals) frame_replace(f, nf *frame) {
+	nf.parent, nf.size = f.parent, f.size
+	if f.parent == nil {
+		g.frame_root = nf
+		return
+	}
+	for i, k := range f.parent.kids {
+		if k == f {
+			f.parent.kids[i] = nf
+		}
+	}
+}
+
+//----- Opening and closing --------------------------------------
+
+// split the current window in two, above and below or (vertical)
+// side by side. The new window is above (left), shows buffer b and
+// becomes the current one.
+func (g *globals) win_split(vertical bool, b *buffer) bool {
+	cur := g.win.frame
+	if (vertical && g.win.width < 3) || (!vertical && g.win.height+TernaryInt(g.win.status, 1, 0) < 4) {
+		g.status_line_bold("Not enough room")
+		return false
+	}
+	nw := &window{buf: g.buffer, dot: g.dot, screenbegin: g.screenbegin}
+	nf := &frame{win: nw}
+	nw.frame = nf
+	if p := cur.parent; p != nil && p.vertical == vertical {
+		i := 0
+		for p.kids[i] != cur {
+			i++
+		}
+		p.kids = append(p.kids[:i], append([]*frame{nf}, p.kids[i:]...)...)
+		nf.parent = p
+		size := cur.size - TernaryInt(vertical, 1, 0) // a new '|' column
+		nf.size = size / 2
+		cur.size = size - nf.size
+	} else {
+		c := &frame{vertical: vertical}
+		g.frame_replace(cur, c)
+		c.kids = []*frame{nf, cur}
+		nf.parent, cur.parent = c, c
+		nf.size, cur.size = 0, 0 // even halves
+	}
+	g.win_enter(nw)
+	g.win_layout()
+	if b != g.buffer {
+		g.buffer_switch(b)
+	} else {
+		g.redraw(true)
+	}
+	return true
+}
+
+// take window w off the screen, its rows or columns go to the
+// frame before it, or the one after. Returns the window that got them.
+func (g *globals) win_remove(w *window) *window {
+	f := w.frame
+	p := f.parent
+	i := 0
+	for p.kids[i] != f {
+		i++
+	}
+	sib := p.kids[TernaryInt(i > 0, i-1, i+1)]
+	sib.size += f.size + TernaryInt(p.vertical, 1, 0)
+	p.kids = append(p.kids[:i], p.kids[i+1:]...)
+	if len(p.kids) == 1 { // the frame is not needed any more
+		k := p.kids[0]
+		g.frame_replace(p, k)
+		if q := k.parent; k.win == nil && q != nil && q.vertical == k.vertical {
+			// frames the same way as the one around them join it
+			j := 0
+			for q.kids[j] != k {
+				j++
+			}
+			for _, kk := range k.kids {
+				kk.parent = q
+			}
+			q.kids = append(q.kids[:j], append(k.kids, q.kids[j+1:]...)...)
+		}
+	}
+	var next *window
+	sib.each(func(w *window) {
+		if next == nil {
+			next = w
+		}
+	})
+	return next
+}
+
+// :clo[se] ctrl-W c, and :q when there are other windows
+func (g *globals) win_close(force bool) {
+	if g.frame_root.win != nil {
+		g.status_line_bold("Cannot close last window")
+		return
+	}
+	if !g.buffer_may_hide(g.win.buf, 1, force) {
+		g.status_line_bold("No write since last change (add ! to override)")
+		return
+	}
+	next := g.win_remove(g.win)
+	g.win_enter(next)
+	g.win_layout()
+	g.redraw(true)
+}
+
+// :on[ly] ctrl-W o  close all other windows, except those with
+// changes that would be lost
+func (g *globals) win_only(force bool) {
+	kept := 0
+	for _, w := range g.windows() {
+		if w == g.win {
+			continue
+		}
+		if !g.buffer_may_hide(w.buf, 1, force) {
+			kept++
+			continue
+		}
+		g.win_remove(w)
+	}
+	if kept > 0 {
+		g.status_line_bold("Other window contains changes")
+	}
+	g.win_layout()
+	g.redraw(true)
+}
+
+//----- Moving between and resizing windows ----------------------
+
+// the window at screen row, col, counting its status line
+func (g *globals) win_at(row, col int) *window {
+	var found *window
+	g.frame_root.each(func(w *window) {
+		if row >= w.top && row <= w.top+w.height && col >= w.left && col < w.left+w.width {
+			found = w
+		}
+	})
+	return found
+}
+
+// ctrl-W h j k l: cnt windows to the left, down, up or right
+func (g *globals) win_goto(dir int, cnt int) {
+	for i := TernaryInt(cnt < 1, 1, cnt); i > 0; i-- {
+		w := g.win
+		row := w.top + TernaryInt(g.crow < w.height, g.crow, w.height-1)
+		col := w.left + TernaryInt(g.ccol < w.width, g.ccol, w.width-1)
+		switch dir {
+		case 'h':
+			col = w.left - 2
+		case 'j':
+			row = w.top + w.height + 1
+		case 'k':
+			row = w.top - 1
+		case 'l':
+			col = w.left + w.width + 1
+		}
+		next := g.win_at(row, col)
+		if next == nil {
+			break
+		}
+		g.win_enter(next)
+		g.sync_cursor(g.dot, &g.crow, &g.ccol)
+	}
+}
+
+// ctrl-W + -: make the window n rows higher, taking them from the
+// window below (or above) it
+func (g *globals) win_resize(n int) {
+	f := g.win.frame
+	for f.parent != nil && f.parent.vertical {
+		f = f.parent
+	}
+	p := f.parent
+	if p == nil {
+		return
+	}
+	i := 0
+	for p.kids[i] != f {
+		i++
+	}
+	sib := p.kids[TernaryInt(i < len(p.kids)-1, i+1, i-1)]
+	n = TernaryInt(sib.size-n < 2, sib.size-2, n)
+	n = TernaryInt(f.size+n < 2, 2-f.size, n)
+	f.size += n
+	sib.size -= n
+	g.win_layout()
+	g.redraw(true)
+}
+
+// ctrl-W =: all windows the same size
+func (g *globals) win_equal() {
+	var zero func(f *frame)
+	zero = func(f *frame) {
+		for _, k := range f.kids {
+			k.size = 0
+			zero(k)
+		}
+	}
+	zero(g.frame_root)
+	g.win_layout()
+	g.redraw(true)
+}
+
+// ctrl-W followed by c
+func (g *globals) win_cmd(c int, cnt int) {
+	switch c {
+	case 's', 'S', 19: // split
+		g.win_split(false, g.buffer)
+	case 'v', 22: // vsplit
+		g.win_split(true, g.buffer)
+	case 'n', 14: // new
+		g.win_split(false, g.buffer_new(""))
+	case 'w', 23, 'W': // next, previous, or window cnt
+		ws := g.windows()
+		i := 0
+		for ws[i] != g.win {
+			i++
+		}
+		if cnt > 0 {
+			i = TernaryInt(cnt > len(ws), len(ws), cnt) - 1
+		} else {
+			i = (i + TernaryInt(c == 'W', len(ws)-1, 1)) % len(ws)
+		}
+		g.win_enter(ws[i])
+	case 'h', 'j', 'k', 'l':
+		g.win_goto(c, cnt)
+	case 8, KEYCODE_LEFT:
+		g.win_goto('h', cnt)
+	case 10, KEYCODE_DOWN:
+		g.win_goto('j', cnt)
+	case 11, KEYCODE_UP:
+		g.win_goto('k', cnt)
+	case 12, KEYCODE_RIGHT:
+		g.win_goto('l', cnt)
+	case 'c':
+		g.win_close(false)
+	case 'o', 15:
+		g.win_only(false)
+	case 'q', 17:
+		g.colon("q")
+	case '=':
+		g.win_equal()
+	case '+', '-':
+		g.win_resize(TernaryInt(cnt < 1, 1, cnt) * TernaryInt(c == '+', 1, -1))
+	}
+}
+
+//----- Drawing ----------------------------------------------------
+
+// the status line of window w: its file name, [+] if changed
+func (g *globals) win_status(w *window) []rune {
+	name := TernaryString(w.buf.current_filename == "", "[No Name]", w.buf.current_filename)
+	if w.buf.modified_count != 0 {
+		name += " [+]"
+	}
+	cells := []rune(visible_text([]byte(fmt.Sprintf(" %s", name)), w.width))
+	for len(cells) < w.width {
+		cells = append(cells, ' ')
+	}
+	cells = cells[:w.width]
+	for i := range cells {
+		cells[i] |= SCR_INVERSE
+	}
+	return cells
+}
+
+// draw the text and status line of the current window, with the
+// visual selection if sel
+func (g *globals) win_refresh(full_screen bool, sel bool) {
+	w := g.win
+	g.screenbegin = g.begin_line(TernaryInt(g.screenbegin > g.text.size(), g.text.size(), g.screenbegin))
+	g.sync_cursor(g.dot, &g.crow, &g.ccol)
+	if sel {
+		g.visual_bounds()
+	}
+	tp := g.screenbegin
+	for li := 0; li < w.height; li++ {
+		out_buf := g.format_line(tp, sel)
+		if tp < g.text.size() {
+			tp = g.next_line(tp)
+		}
+		g.screen_put(w.top+li, w.left, out_buf[:w.width], full_screen)
+	}
+	if w.status {
+		g.screen_put(w.top+w.height, w.left, g.win_status(w), full_screen)
+	}
+	g.format_line_number(g.begin_line(g.dot)) // line_number_width for the cursor line
+}
+
+// draw the '|' columns between windows side by side
+func (g *globals) win_draw_seps(full_screen bool) {
+	for _, s := range g.win_seps {
+		for r := s[0]; r < s[0]+s[2]; r++ {
+			g.screen_put(r, s[1], []rune{'|' | SCR_INVERSE}, full_screen)
+		}
+	}
+}